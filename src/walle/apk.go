@@ -2,11 +2,12 @@ package walle
 
 import (
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
-	"errors"
 	"math"
-	"encoding/json"
 	"bytes"
+	"unicode/utf8"
 )
 
 const (
@@ -19,8 +20,21 @@ const (
 
 	_APK_SIG_BLOCK_MAGIC_HI          = 0x3234206b636f6c42 // LITTLE_ENDIAN, High
 	_APK_SIG_BLOCK_MAGIC_LO          = 0x20676953204b5041 // LITTLE_ENDIAN, Low
-	APK_SIGNATURE_SCHEME_V2_BLOCK_ID = 0x7109871a
-	APK_CHANNEL_BLOCK_ID             = 0x71777777
+	// https://source.android.com/docs/security/features/apksigning/v3
+	APK_SIGNATURE_SCHEME_V2_BLOCK_ID  = 0x7109871a
+	APK_SIGNATURE_SCHEME_V3_BLOCK_ID  = 0xf05368c0
+	APK_SIGNATURE_SCHEME_V31_BLOCK_ID = 0x1b93ad61
+	APK_VERITY_PADDING_BLOCK_ID       = 0x42726577 // pads APK Signing Block to a multiple of 4096 bytes
+	// https://android.googlesource.com/platform/tools/apksig/+/refs/heads/main/src/main/java/com/android/apksig/internal/apk/stamp/SourceStampConstants.java
+	APK_SOURCE_STAMP_V1_BLOCK_ID      = 0x2b09189e
+	APK_SOURCE_STAMP_V2_BLOCK_ID      = 0x6dff800d
+	// encrypted dependency metadata added by Android Gradle Plugin, which only Google Play can read
+	APK_DEPENDENCY_INFO_BLOCK_ID      = 0x504b4453
+	APK_CHANNEL_BLOCK_ID              = 0x71777777
+	// https://github.com/Tencent/VasDolly/blob/master/common/src/main/java/com/leon/channel/common/ChannelConstants.java
+	APK_VASDOLLY_CHANNEL_BLOCK_ID     = 0x881155ff
+	// https://github.com/mcxiaoke/packer-ng-plugin/blob/master/common/src/main/java/com/mcxiaoke/packer/common/PackerCommon.java
+	APK_PACKER_NG_CHANNEL_BLOCK_ID    = 0x7a786b21 // "zxk!"
 	// https://en.wikipedia.org/wiki/Zip_(file_format)
 	// https://android.googlesource.com/platform/build/+/android-7.1.2_r27/tools/signapk/src/com/android/signapk/ZipUtils.java
 	_ZIP_EOCD_REC_SIG                         = 0x06054b50
@@ -30,6 +44,7 @@ const (
 	_ZIP_EOCD_COMMENT_LENGTH_FIELD_OFFSET     = 20
 )
 
+
 type ChannelInfo struct {
 	Channel string
 	Extras  map[string]string
@@ -46,7 +61,9 @@ func (c *ChannelInfo) String() string {
 	}
 }
 
-// ChannelInfo to byte array
+// ChannelInfo to byte array, the json object written by Java walle: keys are in the order
+// of javaPayloadKeys and strings are escaped as org.json's JSONObject.quote does, so that
+// walle-go and Java walle write identical payloads.
 func (c *ChannelInfo) Bytes() []byte {
 	if c.raw != nil {
 		return c.raw
@@ -56,82 +73,131 @@ func (c *ChannelInfo) Bytes() []byte {
 	}
 	var buf bytes.Buffer
 	buf.WriteByte('{')
-	if len(c.Channel) != 0 {
-		buf.WriteString("\"channel\":")
-		buf.WriteByte('"')
-		buf.WriteString(c.Channel)
-		buf.WriteByte('"')
-		buf.WriteByte(',')
-	}
-
-	if c.Extras != nil {
-		for k, v := range c.Extras {
-			buf.WriteByte('"')
-			buf.WriteString(k)
-			buf.WriteByte('"')
-			buf.WriteByte(':')
-			buf.WriteByte('"')
-			buf.WriteString(v)
-			buf.WriteByte('"')
+	for i, k := range javaPayloadKeys(c.Channel, c.Extras) {
+		if i > 0 {
 			buf.WriteByte(',')
 		}
+		v := c.Extras[k]
+		if k == "channel" {
+			v = c.Channel
+		}
+		writeJSONString(&buf, k)
+		buf.WriteByte(':')
+		writeJSONString(&buf, v)
 	}
-	if buf.Len() > 2 {
-		buf.Truncate(buf.Len() - 1)
-	}
-
 	buf.WriteByte('}')
 
 	return buf.Bytes()
 }
 
-func readChannelInfo(file string) (c ChannelInfo, err error) {
-	block, err := readChannelBlock(file)
-	if err != nil {
-		return c, err
+// Write s as a json string in the same way as org.json's JSONObject.quote: '/' is escaped
+// after '<' only, control characters, U+0080 to U+009F and U+2000 to U+20FF are escaped
+// in \uXXXX, other characters are written in UTF-8.
+func writeJSONString(buf *bytes.Buffer, s string) {
+	var prev rune
+	buf.WriteByte('"')
+	for i, c := range s {
+		switch c {
+		case '"', '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(c)
+		case '/':
+			if prev == '<' {
+				buf.WriteByte('\\')
+			}
+			buf.WriteRune(c)
+		case '\n':
+			buf.WriteString("\\n")
+		case '\r':
+			buf.WriteString("\\r")
+		case '\t':
+			buf.WriteString("\\t")
+		case '\b':
+			buf.WriteString("\\b")
+		case '\f':
+			buf.WriteString("\\f")
+		default:
+			if c < 0x20 || (c >= 0x80 && c < 0xa0) || (c >= 0x2000 && c < 0x2100) {
+				fmt.Fprintf(buf, "\\u%04x", c)
+			} else if c == utf8.RuneError {
+				// invalid UTF-8 is kept as it is
+				_, n := utf8.DecodeRuneInString(s[i:])
+				buf.WriteString(s[i : i+n])
+			} else {
+				buf.WriteRune(c)
+			}
+		}
+		prev = c
 	}
+	buf.WriteByte('"')
+}
 
-	if block != nil {
-		var bundle map[string]string
-		err := json.Unmarshal(block, &bundle)
-		if err != nil {
-			return c, err
-		}
-		c.Channel = bundle["channel"]
-		delete(bundle, "channel")
-		c.Extras = bundle
-		c.raw = block
+// ReadOptions controls how apks are read.
+type ReadOptions struct {
+	// Logger, if not nil, logs details of reading at debug level, e.g. sections of apk.
+	Logger *slog.Logger
+}
+
+// ReadChannelInfo reads the channel info of apk file, it returns ErrNoChannel if no channel
+// is written. See errors.go for other errors.
+func ReadChannelInfo(file string, opts ReadOptions) (ChannelInfo, error) {
+	c, err := readChannelInfo(file, loggerOf(opts.Logger))
+	if err == nil && c.raw == nil {
+		err = ErrNoChannel
 	}
-	return c, nil
+	return c, err
 }
 
-// read block associated to APK_CHANNEL_BLOCK_ID
-func readChannelBlock(file string) ([]byte, error) {
-	m, err := readIdValues(file, APK_CHANNEL_BLOCK_ID)
+// Read the channel info by the first codec of channelCodecs found in file, c.raw is nil if
+// no channel is written.
+func readChannelInfo(file string, logger *slog.Logger) (c ChannelInfo, err error) {
+	ids := make([]uint32, len(channelCodecs))
+	for i, codec := range channelCodecs {
+		ids[i] = codec.blockId()
+	}
+	m, err := readIdValues(file, logger, ids...)
 	if err != nil {
-		return nil, err
+		return c, err
+	}
+	for _, codec := range channelCodecs {
+		if block, ok := m[codec.blockId()]; ok {
+			if c, err = codec.decode(block); err != nil {
+				return c, err
+			}
+			c.raw = block
+			return c, nil
+		}
 	}
-	return m[APK_CHANNEL_BLOCK_ID], nil
+	return c, nil
 }
 
-func readIdValues(file string, ids ... uint32) (map[uint32][]byte, error) {
+func readIdValues(file string, logger *slog.Logger, ids ... uint32) (map[uint32][]byte, error) {
 	f, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	eocd, offset, err := findEndOfCentralDirectoryRecord(f)
+	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
-	if offset <= 0 {
-		return nil, errors.New("Cannot find EOCD record, maybe a broken zip file.")
+	eocd, offset, err := findEndOfCentralDirectoryRecord(f, fi.Size())
+	if err != nil {
+		return nil, err
 	}
-	centralDirOffset := getEocdCentralDirectoryOffset(eocd)
-	block, _, err := findApkSigningBlock(f, centralDirOffset)
+	if eocd == nil {
+		return nil, ErrNoEOCD
+	}
+	centralDirOffset, _, err := eocdCentralDirectory(eocd, offset)
 	if err != nil {
 		return nil, err
 	}
+	block, blockOffset, err := findApkSigningBlock(f, centralDirOffset)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("read apk", "file", file, "size", fi.Size(), "eocdOffset", offset,
+		"centralDirOffset", centralDirOffset, "signingBlockOffset", blockOffset, "signingBlockSize", len(block))
 	return findIdValuesInApkSigningBlock(block, ids...)
 }
 
@@ -150,19 +216,15 @@ func readIdValues(file string, ids ... uint32) (map[uint32][]byte, error) {
 // For a zip with no archive comment, the
 // end-of-central-directory record will be 22 bytes long, so
 // we expect to find the EOCD marker 22 bytes from the end.
-func findEndOfCentralDirectoryRecord(f *os.File) ([]byte, int64, error) {
-	fi, err := f.Stat()
-	if err != nil {
-		return nil, -1, err
-	}
-	if fi.Size() < _ZIP_EOCD_REC_MIN_SIZE {
+func findEndOfCentralDirectoryRecord(r io.ReaderAt, fileSize int64) ([]byte, int64, error) {
+	if fileSize < _ZIP_EOCD_REC_MIN_SIZE {
 		// No space for EoCD record in the file.
 		return nil, -1, nil
 	}
 	// Optimization: 99.99% of APKs have a zero-length comment field in the EoCD record and thus
 	// the EoCD record offset is known in advance. Try that offset first to avoid unnecessarily
 	// reading more data.
-	ret, offset, err := findEOCDRecord(f, 0)
+	ret, offset, err := findEOCDRecord(r, fileSize, 0)
 	if err != nil {
 		return nil, -1, err
 	}
@@ -172,44 +234,42 @@ func findEndOfCentralDirectoryRecord(f *os.File) ([]byte, int64, error) {
 	// EoCD does not start where we expected it to. Perhaps it contains a non-empty comment
 	// field. Expand the search. The maximum size of the comment field in EoCD is 65535 because
 	// the comment length field is an unsigned 16-bit number.
-	return findEOCDRecord(f, math.MaxUint16)
+	return findEOCDRecord(r, fileSize, math.MaxUint16)
 }
 
-func findEOCDRecord(f *os.File, maxCommentSize uint16) ([]byte, int64, error) {
-	if (maxCommentSize < 0) || maxCommentSize > math.MaxUint16 {
+func findEOCDRecord(r io.ReaderAt, fileSize int64, maxCommentSize int) ([]byte, int64, error) {
+	if maxCommentSize < 0 || maxCommentSize > math.MaxUint16 {
 		return nil, -1, os.ErrInvalid
 	}
-	fi, err := f.Stat()
-	if err != nil {
-		return nil, -1, err
-	}
-	fileSize := fi.Size()
 	if fileSize < _ZIP_EOCD_REC_MIN_SIZE {
 		// No space for EoCD record in the file.
 		return nil, -1, nil
 	}
 	// Lower maxCommentSize if the file is too small.
-	if s := uint16(fileSize - _ZIP_EOCD_REC_MIN_SIZE); maxCommentSize > s {
-		maxCommentSize = s
+	if s := fileSize - _ZIP_EOCD_REC_MIN_SIZE; int64(maxCommentSize) > s {
+		maxCommentSize = int(s)
 	}
 	maxEocdSize := _ZIP_EOCD_REC_MIN_SIZE + maxCommentSize
 	bufOffsetInFile := fileSize - int64(maxEocdSize)
 	buf := make([]byte, maxEocdSize)
-	n, e := f.ReadAt(buf, bufOffsetInFile)
-	if e != nil {
+	n, err := r.ReadAt(buf, bufOffsetInFile)
+	if n != len(buf) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return nil, -1, err
 	}
 	eocdOffsetInFile :=
 		func() int64 {
 			eocdWithEmptyCommentStartPosition := n - _ZIP_EOCD_REC_MIN_SIZE
-			for expectedCommentLength := uint16(0);
-				expectedCommentLength < maxCommentSize;
+			for expectedCommentLength := 0;
+				expectedCommentLength <= maxCommentSize;
 			expectedCommentLength ++ {
-				eocdStartPos := eocdWithEmptyCommentStartPosition - int(expectedCommentLength)
-				if getUint32(buf, eocdStartPos) == _ZIP_EOCD_REC_SIG {
+				eocdStartPos := eocdWithEmptyCommentStartPosition - expectedCommentLength
+				if sig, ok := getUint32(buf, eocdStartPos); ok && sig == _ZIP_EOCD_REC_SIG {
 					n := eocdStartPos + _ZIP_EOCD_COMMENT_LENGTH_FIELD_OFFSET
-					actualCommentLength := getUint16(buf, n)
-					if actualCommentLength == expectedCommentLength {
+					actualCommentLength, ok := getUint16(buf, n)
+					if ok && int(actualCommentLength) == expectedCommentLength {
 						return int64(eocdStartPos)
 					}
 				}
@@ -225,10 +285,52 @@ func findEOCDRecord(f *os.File, maxCommentSize uint16) ([]byte, int64, error) {
 
 }
 
-func getEocdCentralDirectoryOffset(buf []byte) uint32 {
+// Returns the offset and size of the central directory recorded in eocd, which must lie
+// before the EOCD record at eocdOffset.
+func eocdCentralDirectory(eocd []byte, eocdOffset int64) (offset, size uint32, err error) {
+	offset, ok1 := getEocdCentralDirectoryOffset(eocd)
+	size, ok2 := getEocdCentralDirectorySize(eocd)
+	if !ok1 || !ok2 {
+		return 0, 0, fmt.Errorf("EOCD record is too short, %d bytes", len(eocd))
+	}
+	if int64(offset)+int64(size) > eocdOffset {
+		return 0, 0, fmt.Errorf("central directory [%d, %d) is out of range, EOCD record is at %d",
+			offset, int64(offset)+int64(size), eocdOffset)
+	}
+	return
+}
+
+// SigningBlockIdName returns the name of the known ID-value pair in APK Signing Block, empty if unknown.
+func SigningBlockIdName(id uint32) string {
+	switch id {
+	case APK_SIGNATURE_SCHEME_V2_BLOCK_ID:
+		return "APK Signature Scheme v2"
+	case APK_SIGNATURE_SCHEME_V3_BLOCK_ID:
+		return "APK Signature Scheme v3"
+	case APK_SIGNATURE_SCHEME_V31_BLOCK_ID:
+		return "APK Signature Scheme v3.1"
+	case APK_VERITY_PADDING_BLOCK_ID:
+		return "verity padding"
+	case APK_SOURCE_STAMP_V1_BLOCK_ID:
+		return "source stamp v1"
+	case APK_SOURCE_STAMP_V2_BLOCK_ID:
+		return "source stamp v2"
+	case APK_DEPENDENCY_INFO_BLOCK_ID:
+		return "dependency info"
+	case APK_CHANNEL_BLOCK_ID:
+		return "walle channel"
+	case APK_VASDOLLY_CHANNEL_BLOCK_ID:
+		return "VasDolly channel"
+	case APK_PACKER_NG_CHANNEL_BLOCK_ID:
+		return "packer-ng channel"
+	}
+	return ""
+}
+
+func getEocdCentralDirectoryOffset(buf []byte) (uint32, bool) {
 	return getUint32(buf, _ZIP_EOCD_CENTRAL_DIR_OFFSET_FIELD_OFFSET)
 }
-func getEocdCentralDirectorySize(buf []byte) uint32 {
+func getEocdCentralDirectorySize(buf []byte) (uint32, bool) {
 	return getUint32(buf, _ZIP_EOCD_CENTRAL_DIR_SIZE_FIELD_OFFSET)
 }
 
@@ -247,31 +349,45 @@ func isExpected(ids []uint32, test uint32) bool {
 
 func findIdValuesInApkSigningBlock(block []byte, ids ...uint32) (map[uint32][]byte, error) {
 	ret := make(map[uint32][]byte)
+	err := walkApkSigningBlock(block, func(id uint32, value []byte) {
+		if len(ids) == 0 || isExpected(ids, id) {
+			ret[id] = value
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Walk through the ID-value pairs of APK Signing Block in the order they are stored.
+func walkApkSigningBlock(block []byte, fn func(id uint32, value []byte)) error {
+	if len(block) < int(_APK_SIG_BLOCK_MIN_SIZE) {
+		return corruptSigningBlock(0, "too small: %d bytes", len(block))
+	}
 	position := 8
 	limit := len(block) - 24
 	entryCount := 0
 	for limit > position { // has remaining bytes
 		entryCount ++
-		if limit-position < 8 { // but not enough
-			return nil, fmt.Errorf("APK Signing Block broken on entry #%d", entryCount)
+		size, ok := getUint64(block[:limit], position)
+		if !ok { // but not enough
+			return corruptSigningBlock(entryCount, "not enough bytes for size: remaining=%d", limit-position)
 		}
-		length := int(getUint64(block, position))
 		position += 8
 
-		if length < 4 || length > limit-position {
-			return nil, fmt.Errorf("APK Signing Block broken on entry #%d,"+
-				" size out of range: length=%d, remaining=%d", entryCount, length, limit-position)
+		length := int(size)
+		if size > uint64(limit-position) || length < 4 {
+			return corruptSigningBlock(entryCount, "size out of range: length=%d, remaining=%d", length, limit-position)
 		}
 		nextEntryPosition := position + length
-		id := getUint32(block, position)
+		id, _ := getUint32(block, position) // length >= 4 as checked above
 		position += 4
-		if len(ids) == 0 || isExpected(ids, id) {
-			ret[id] = block[position:position+length-4]
-		}
+		fn(id, block[position:position+length-4])
 		position = nextEntryPosition
 
 	}
-	return ret, nil
+	return nil
 }
 
 // Find the APK Signing Block. The block immediately precedes the Central Directory.
@@ -284,11 +400,11 @@ func findIdValuesInApkSigningBlock(block []byte, ids ...uint32) (map[uint32][]by
 //	     (size - 4) bytes: value
 //	 uint64:  size (same as the one above)
 //	 uint128: magic
-func findApkSigningBlock(f *os.File, centralDirOffset uint32) (block []byte, offset int64, err error) {
+func findApkSigningBlock(f io.ReaderAt, centralDirOffset uint32) (block []byte, offset int64, err error) {
 
 	if centralDirOffset < _APK_SIG_BLOCK_MIN_SIZE {
-		return block, offset, fmt.Errorf("APK too small for APK Signing Block."+
-			" ZIP Central Directory offset: %d", centralDirOffset)
+		return block, offset, fmt.Errorf("%w, APK too small for APK Signing Block."+
+			" ZIP Central Directory offset: %d", ErrNoSigningBlock, centralDirOffset)
 	}
 	// Read the footer of APK signing block
 	// 24 = sizeof(uint128) + sizeof(uint64)
@@ -298,13 +414,14 @@ func findApkSigningBlock(f *os.File, centralDirOffset uint32) (block []byte, off
 		return
 	}
 	// Read the magic and block size
-	var blockSizeInFooter = getUint64(footer, 0)
-	if blockSizeInFooter < 24 || blockSizeInFooter > uint64(math.MaxInt32-8 /* ID-value size field*/) {
-		return block, offset, fmt.Errorf("APK Signing Block size out of range: %d", blockSizeInFooter)
+	magicLo, _ := getUint64(footer, 8)
+	magicHi, _ := getUint64(footer, 16)
+	if magicLo != _APK_SIG_BLOCK_MAGIC_LO || magicHi != _APK_SIG_BLOCK_MAGIC_HI {
+		return block, offset, ErrNoSigningBlock
 	}
-	if getUint64(footer, 8) != _APK_SIG_BLOCK_MAGIC_LO ||
-		getUint64(footer, 16) != _APK_SIG_BLOCK_MAGIC_HI {
-		return block, offset, errors.New("No APK Signing Block before ZIP Central Directory")
+	blockSizeInFooter, _ := getUint64(footer, 0)
+	if blockSizeInFooter < 24 || blockSizeInFooter > uint64(math.MaxInt32-8 /* ID-value size field*/) {
+		return block, offset, corruptSigningBlock(0, "size out of range: %d", blockSizeInFooter)
 	}
 
 	totalSize := blockSizeInFooter + 8 /* APK signing block size field*/
@@ -312,22 +429,40 @@ func findApkSigningBlock(f *os.File, centralDirOffset uint32) (block []byte, off
 	offset = int64(uint64(centralDirOffset) - totalSize)
 
 	if offset <= 0 {
-		return block, offset, fmt.Errorf("invalid offset for APK Signing Block %d", offset)
+		return block, offset, corruptSigningBlock(0, "invalid offset %d", offset)
 	}
 	block = make([]byte, totalSize)
 	_, err = f.ReadAt(block, offset)
 	if err != nil {
 		return
 	}
-	blockSizeInHeader := getUint64(block, 0)
+	blockSizeInHeader, _ := getUint64(block, 0) // totalSize >= 32
 	if blockSizeInHeader != blockSizeInFooter {
-		return nil, offset, fmt.Errorf("APK Signing Block sizes in header "+
+		return nil, offset, corruptSigningBlock(0, "sizes in header "+
 			"and footer are mismatched! Except %d but %d", blockSizeInFooter, blockSizeInHeader)
 	}
 
 	return block, offset, nil
 }
 
+// Make a new APK Signing Block with channel info appended by codec, the ID-value pairs in
+// drop are removed from it, and returns it along with the size changed.
+func makeSigningBlockWithChannelInfo(info ChannelInfo, codec channelCodec, signingBlock []byte, drop []uint32) ([]byte, int, error) {
+	value, err := codec.encode(info)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rebuildSigningBlock(signingBlock, func(id uint32) bool {
+		return !isExpected(drop, id)
+	}, idValue{codec.blockId(), value})
+}
+
+// Rebuild APK Signing Block with the ID-value pairs for which keep returns true, in the
+// same order, and then pairs appended. It returns the new block and the size changed, by
+// which the offset of central directory in EOCD is moved.
+// The verity padding, if kept, is moved to the end and resized so that the new block is
+// still a multiple of 4096 bytes, as Java walle and apksig do.
+//
 // FORMAT:
 // uint64:  size (excluding this field)
 // repeated ID-value pairs:
@@ -336,41 +471,80 @@ func findApkSigningBlock(f *os.File, centralDirOffset uint32) (block []byte, off
 //     (size - 4) bytes: value
 // uint64:  size (same as the one above)
 // uint128: magic
-func makeSigningBlockWithChannelInfo(info ChannelInfo, signingBlock []byte) ([]byte, int, error) {
-
-	signingBlockSize := getUint64(signingBlock, 0)
-	signingBlockLen := len(signingBlock)
-	if n := uint64(signingBlockLen - 8); signingBlockSize != n {
-		return nil, 0, fmt.Errorf("APK Signing Block is illegal! Expect size %d but %d", signingBlockSize, n)
+func rebuildSigningBlock(signingBlock []byte, keep func(id uint32) bool, pairs ...idValue) ([]byte, int, error) {
+
+	if len(signingBlock) < int(_APK_SIG_BLOCK_MIN_SIZE) {
+		return nil, 0, corruptSigningBlock(0, "too small: %d bytes", len(signingBlock))
+	}
+	signingBlockSize, _ := getUint64(signingBlock, 0)
+	if n := uint64(len(signingBlock) - 8); signingBlockSize != n {
+		return nil, 0, corruptSigningBlock(0, "expect size %d but %d", signingBlockSize, n)
+	}
+	var kept []idValue
+	padded := false
+	err := walkApkSigningBlock(signingBlock, func(id uint32, value []byte) {
+		if id == APK_VERITY_PADDING_BLOCK_ID {
+			padded = padded || keep(id)
+		} else if keep(id) {
+			kept = append(kept, idValue{id, value})
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	kept = append(kept, pairs...)
+	if padded {
+		kept = appendVerityPadding(kept)
 	}
+	newBlock := makeApkSigningBlock(kept)
+	return newBlock, len(newBlock) - len(signingBlock), nil
+}
 
-	channelValue := info.Bytes()
-	channelValueSize := uint64(4 + len(channelValue))
-	resultSize := 8 + signingBlockSize + 8 + channelValueSize
+type idValue struct {
+	id    uint32
+	value []byte
+}
 
-	newBlock := make([]byte, resultSize)
+// Make a new APK Signing Block holding the ID-value pairs in order.
+func makeApkSigningBlock(pairs []idValue) []byte {
+	size := 8 + 16 // size field in footer + magic
+	for _, p := range pairs {
+		size += 8 + 4 + len(p.value)
+	}
+	block := make([]byte, 8+size)
 	position := 0
-	putUint64(resultSize-8, newBlock, position)
-	position += 8
-	// copy raw id-value pairs
-	n, _ := copyBytes(signingBlock, 8, newBlock, position, int(signingBlockSize)-16-8)
-	position += n
-	putUint64(channelValueSize, newBlock, position)
+	putUint64(uint64(size), block, position)
 	position += 8
-	putUint32(APK_CHANNEL_BLOCK_ID, newBlock, position)
-	position += 4
-	n, _ = copyBytes(channelValue, 0, newBlock, position, len(channelValue))
-	position += n
-
-	putUint64(resultSize-8, newBlock, position)
+	for _, p := range pairs {
+		putUint64(uint64(4+len(p.value)), block, position)
+		position += 8
+		putUint32(p.id, block, position)
+		position += 4
+		position += copy(block[position:], p.value)
+	}
+	putUint64(uint64(size), block, position)
 	position += 8
-	copyBytes(signingBlock, signingBlockLen-16, newBlock, int(resultSize-16), 16)
-	position += 16
+	putUint64(_APK_SIG_BLOCK_MAGIC_LO, block, position)
+	putUint64(_APK_SIG_BLOCK_MAGIC_HI, block, position+8)
+	return block
+}
 
-	if position != int(resultSize) {
-		return nil, -1, fmt.Errorf("count mismatched ! %d vs %d", position, resultSize)
+// Append the verity padding to pairs, which pads APK Signing Block of them to a multiple of
+// 4096 bytes, the same as ApkSigningBlockUtils.generateApkSigningBlock of apksig.
+func appendVerityPadding(pairs []idValue) []idValue {
+	const pageSize = 4096
+	size := 8 + 8 + 16 // size fields + magic
+	for _, p := range pairs {
+		size += 8 + 4 + len(p.value)
+	}
+	if size%pageSize == 0 {
+		return pairs
+	}
+	padding := pageSize - size%pageSize
+	if padding < 8+4 {
+		padding += pageSize
 	}
-	return newBlock, int(resultSize) - signingBlockLen, nil
+	return append(pairs, idValue{APK_VERITY_PADDING_BLOCK_ID, make([]byte, padding-8-4)})
 }
 
 func makeEocd(origin []byte, newCentralDirOffset uint32) []byte {
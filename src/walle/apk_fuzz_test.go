@@ -0,0 +1,101 @@
+package walle
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// FuzzFindEOCDRecord parses arbitrary bytes as an apk, and writes a channel into it when
+// it is parsed. Seeds are in testdata/fuzz/FuzzFindEOCDRecord.
+func FuzzFindEOCDRecord(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		eocd, eocdOffset, err := findEndOfCentralDirectoryRecord(r, int64(len(data)))
+		if err != nil || eocd == nil {
+			return
+		}
+		if eocdOffset < 0 || eocdOffset+int64(len(eocd)) > int64(len(data)) {
+			t.Fatalf("EOCD record [%d, %d) is out of %d bytes", eocdOffset, eocdOffset+int64(len(eocd)), len(data))
+		}
+		if !bytes.Equal(eocd, data[eocdOffset:eocdOffset+int64(len(eocd))]) {
+			t.Fatalf("EOCD record is not the bytes at %d", eocdOffset)
+		}
+		eocdFields(eocd)
+
+		z, err := newZipSections(r, int64(len(data)))
+		if err != nil {
+			return
+		}
+		if int64(len(z.signingBlock)) != z.centralDirOffset-z.signingBlockOffset {
+			t.Fatalf("APK Signing Block of %d bytes at %d does not end at central directory at %d",
+				len(z.signingBlock), z.signingBlockOffset, z.centralDirOffset)
+		}
+		if err = walkApkSigningBlock(z.signingBlock, func(uint32, []byte) {}); err != nil {
+			return
+		}
+		cr, err := z.channelReader(ChannelInfo{Channel: "fuzz"}, walleCodec{})
+		if err != nil {
+			return
+		}
+		out, err := io.ReadAll(cr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(out)) != cr.Size() {
+			t.Fatalf("read %d bytes, but size is %d", len(out), cr.Size())
+		}
+		c, err := channelOf(out)
+		if err != nil {
+			t.Fatalf("cannot read channel written, %s", err)
+		}
+		if c.Channel != "fuzz" {
+			t.Fatalf("channel is %q, expect fuzz", c.Channel)
+		}
+	})
+}
+
+// FuzzWalkApkSigningBlock walks arbitrary bytes as APK Signing Block, and rebuilds it with
+// a channel when it is walked. Seeds are in testdata/fuzz/FuzzWalkApkSigningBlock.
+func FuzzWalkApkSigningBlock(f *testing.F) {
+	f.Fuzz(func(t *testing.T, block []byte) {
+		var ids []uint32
+		err := walkApkSigningBlock(block, func(id uint32, value []byte) {
+			ids = append(ids, id)
+		})
+		if err != nil {
+			return
+		}
+		for _, codec := range channelCodecs {
+			info := ChannelInfo{Channel: "fuzz"}
+			newBlock, diffSize, err := makeSigningBlockWithChannelInfo(info, codec, block, channelBlockIds())
+			if err != nil {
+				continue
+			}
+			if len(newBlock)-len(block) != diffSize {
+				t.Fatalf("size changed by %d, but reported %d", len(newBlock)-len(block), diffSize)
+			}
+			m, err := findIdValuesInApkSigningBlock(newBlock, codec.blockId())
+			if err != nil {
+				t.Fatalf("cannot walk the rebuilt block, %s", err)
+			}
+			c, err := codec.decode(m[codec.blockId()])
+			if err != nil || c.Channel != "fuzz" {
+				t.Fatalf("channel in %s is %q, %v", codec.format(), c.Channel, err)
+			}
+		}
+	})
+}
+
+// channelOf returns channel info in FormatWalle of the apk in b.
+func channelOf(b []byte) (ChannelInfo, error) {
+	z, err := newZipSections(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return ChannelInfo{}, err
+	}
+	m, err := findIdValuesInApkSigningBlock(z.signingBlock, APK_CHANNEL_BLOCK_ID)
+	if err != nil {
+		return ChannelInfo{}, err
+	}
+	return walleCodec{}.decode(m[APK_CHANNEL_BLOCK_ID])
+}
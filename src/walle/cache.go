@@ -0,0 +1,142 @@
+package walle
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Cache keeps the parsed sections (offsets, APK Signing Block, central directory and EOCD)
+// of apks for long-lived processes which generate channels from the same apks repeatedly.
+//
+// Entries are keyed by path, size and modification time, so a replaced apk is parsed again.
+// Least recently used entries are evicted once the total bytes held exceeds the limit.
+// It is safe for concurrent use.
+type Cache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	lru      *list.List               // front is the most recently used
+	entries  map[string]*list.Element // path -> *cacheEntry
+}
+
+type cacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+	z       zipSections // without source
+}
+
+func (e *cacheEntry) bytes() int64 {
+	return int64(len(e.z.signingBlock) + len(e.z.centraDir) + len(e.z.eocd))
+}
+
+// NewCache returns a cache which holds at most maxBytes of parsed sections.
+func NewCache(maxBytes int64) *Cache {
+	return &Cache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// WriteChannelTo writes the apk at path with channel info in format to w, like the
+// package-level WriteChannelTo, and returns the number of bytes written.
+func (c *Cache) WriteChannelTo(w io.Writer, path string, info ChannelInfo, format ChannelFormat) (int64, error) {
+	codec, err := codecOf(format)
+	if err != nil {
+		return 0, err
+	}
+	r, f, _, err := c.open(path, info, codec)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, r)
+}
+
+// ChannelApkSize returns the number of bytes which WriteChannelTo would write.
+func (c *Cache) ChannelApkSize(path string, info ChannelInfo, format ChannelFormat) (int64, error) {
+	codec, err := codecOf(format)
+	if err != nil {
+		return 0, err
+	}
+	r, f, _, err := c.open(path, info, codec)
+	if err != nil {
+		return 0, err
+	}
+	f.Close()
+	return r.Size(), nil
+}
+
+// open returns the reader of the apk at path with channel info, the returned file must be
+// closed after reading.
+func (c *Cache) open(path string, info ChannelInfo, codec channelCodec) (*io.SectionReader, *os.File, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// stat the opened file rather than path, so that the key matches what is read
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	z, ok := c.get(path, fi)
+	if !ok {
+		if z, err = newZipSections(f, fi.Size()); err != nil {
+			f.Close()
+			return nil, nil, nil, err
+		}
+		c.put(path, fi, z)
+	}
+	z.source = f
+	r, err := z.channelReader(info, codec)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	return r, f, fi, nil
+}
+
+func (c *Cache) get(path string, fi os.FileInfo) (zipSections, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[path]
+	if !ok {
+		return zipSections{}, false
+	}
+	e := el.Value.(*cacheEntry)
+	if e.size != fi.Size() || !e.modTime.Equal(fi.ModTime()) {
+		c.remove(el)
+		return zipSections{}, false
+	}
+	c.lru.MoveToFront(el)
+	return e.z, true
+}
+
+func (c *Cache) put(path string, fi os.FileInfo, z zipSections) {
+	z.source = nil
+	e := &cacheEntry{path: path, size: fi.Size(), modTime: fi.ModTime(), z: z}
+	if e.bytes() > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[path]; ok {
+		c.remove(el)
+	}
+	c.entries[path] = c.lru.PushFront(e)
+	c.bytes += e.bytes()
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.path)
+	c.bytes -= e.bytes()
+}
@@ -0,0 +1,171 @@
+package walle
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// cacheOp puts sections of n bytes of the file path, or gets them if n is 0.
+type cacheOp struct {
+	path    string
+	n       int
+	size    int64 // file size
+	modTime int64 // unix seconds
+	hit     bool  // expected result of get
+}
+
+func TestCacheLRU(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int64
+		ops      []cacheOp
+		want     []string // paths from the most recently used
+		bytes    int64
+	}{
+		{"least recently used is evicted", 30, []cacheOp{
+			{path: "a", n: 10}, {path: "b", n: 10}, {path: "c", n: 10},
+			{path: "a", hit: true}, {path: "d", n: 10},
+		}, []string{"d", "a", "c"}, 30},
+		{"get moves to front", 30, []cacheOp{
+			{path: "a", n: 10}, {path: "b", n: 10}, {path: "a", hit: true},
+		}, []string{"a", "b"}, 20},
+		{"several are evicted for a large one", 30, []cacheOp{
+			{path: "a", n: 10}, {path: "b", n: 10}, {path: "c", n: 10}, {path: "d", n: 25},
+		}, []string{"d"}, 25},
+		{"larger than maxBytes is not cached", 10, []cacheOp{
+			{path: "a", n: 5}, {path: "b", n: 11}, {path: "b"},
+		}, []string{"a"}, 5},
+		{"put again replaces", 30, []cacheOp{
+			{path: "a", n: 10}, {path: "b", n: 10}, {path: "a", n: 15},
+		}, []string{"a", "b"}, 25},
+		{"size changed", 30, []cacheOp{
+			{path: "a", n: 10, size: 100}, {path: "b", n: 10}, {path: "a", size: 101},
+		}, []string{"b"}, 10},
+		{"modification time changed", 30, []cacheOp{
+			{path: "a", n: 10, modTime: 1}, {path: "a", modTime: 2},
+		}, nil, 0},
+		{"same size and modification time", 30, []cacheOp{
+			{path: "a", n: 10, size: 100, modTime: 1}, {path: "a", size: 100, modTime: 1, hit: true},
+		}, []string{"a"}, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(tt.maxBytes)
+			for i, op := range tt.ops {
+				fi := cacheFileInfo{size: op.size, modTime: time.Unix(op.modTime, 0)}
+				if op.n != 0 {
+					c.put(op.path, fi, zipSections{signingBlock: make([]byte, op.n)})
+					continue
+				}
+				if _, hit := c.get(op.path, fi); hit != op.hit {
+					t.Errorf("op %d: get %s hit %v, want %v", i, op.path, hit, op.hit)
+				}
+			}
+			var got []string
+			for el := c.lru.Front(); el != nil; el = el.Next() {
+				got = append(got, el.Value.(*cacheEntry).path)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("entries %v, want %v", got, tt.want)
+			}
+			if len(c.entries) != len(got) {
+				t.Errorf("%d entries indexed, but %d in list", len(c.entries), len(got))
+			}
+			if c.bytes != tt.bytes {
+				t.Errorf("%d bytes, want %d", c.bytes, tt.bytes)
+			}
+		})
+	}
+}
+
+// TestCacheWriteChannelTo writes channel apks through the cache, which must be the ones
+// written without it, also after the apk is replaced.
+func TestCacheWriteChannelTo(t *testing.T) {
+	dir := t.TempDir()
+	base := testSignedApk(t, dir)
+	c := NewCache(1 << 20)
+	info := ChannelInfo{Channel: "meituan", Extras: map[string]string{"k": "v"}}
+
+	check := func() {
+		t.Helper()
+		data, err := os.ReadFile(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want bytes.Buffer
+		if _, err = WriteChannelTo(&want, bytes.NewReader(data), int64(len(data)), info, FormatWalle); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ { // parsed, then cached
+			var got bytes.Buffer
+			n, err := c.WriteChannelTo(&got, base, info, FormatWalle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size, err := c.ChannelApkSize(base, info, FormatWalle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != size || !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Fatalf("cache writes %d bytes, size %d, but %d bytes without cache", n, size, want.Len())
+			}
+		}
+		fi, err := os.Stat(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := c.get(base, fi); !ok {
+			t.Fatal("apk is not cached")
+		}
+	}
+	check()
+
+	// replaced by an apk signed by another key with v2 only, at the same modification time
+	fi, err := os.Stat(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Sign(testZip(t, dir), base, key, []*x509.Certificate{testCertificate(t, key)}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(base, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// a channel apk is rejected as its base, also when it is cached
+	generated, err := Generate(context.Background(), base, dir, []ChannelInfo{info}, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err = c.ChannelApkSize(generated[0].Output, info, FormatWalle); err == nil {
+			t.Error("no error for apk with a channel")
+		}
+	}
+	if _, err = c.ChannelApkSize(filepath.Join(dir, "missing.apk"), info, FormatWalle); err == nil {
+		t.Error("no error for missing apk")
+	}
+}
+
+type cacheFileInfo struct {
+	os.FileInfo
+	size    int64
+	modTime time.Time
+}
+
+func (fi cacheFileInfo) Size() int64        { return fi.size }
+func (fi cacheFileInfo) ModTime() time.Time { return fi.modTime }
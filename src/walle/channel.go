@@ -0,0 +1,90 @@
+package walle
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// DefaultChannelPattern is the pattern of valid channels if no other pattern is specified:
+// any characters but path separators and control characters, so that e.g. non-ASCII
+// channels are accepted.
+var DefaultChannelPattern = regexp.MustCompile(`^[^/\\\x00-\x1f\x7f]+$`)
+
+// InvalidChannel is a channel rejected by ValidateChannels.
+type InvalidChannel struct {
+	Index   int // index in the validated channels
+	Channel string
+	Reason  string
+}
+
+// InvalidChannelsError reports all invalid channels found by ValidateChannels.
+type InvalidChannelsError struct {
+	Channels []InvalidChannel
+}
+
+func (e *InvalidChannelsError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d invalid channel(s):", len(e.Channels))
+	for _, c := range e.Channels {
+		fmt.Fprintf(&b, "\n    #%d %q: %s", c.Index+1, c.Channel, c.Reason)
+	}
+	return b.String()
+}
+
+// ValidateChannels checks all channels before any apk is written, and reports all invalid
+// ones in an *InvalidChannelsError. A channel is invalid if it is
+//   - empty
+//   - not matching pattern, DefaultChannelPattern if pattern is nil
+//   - duplicated, or its file name (see ChannelFileName) is duplicated with another one's
+func ValidateChannels(channels []string, pattern *regexp.Regexp) error {
+	if pattern == nil {
+		pattern = DefaultChannelPattern
+	}
+	var invalid []InvalidChannel
+	seen := make(map[string]int)
+	seenFileNames := make(map[string]int)
+	for i, c := range channels {
+		fileName := ChannelFileName(c)
+		j, duplicated := seen[c]
+		k, duplicatedFileName := seenFileNames[fileName]
+		reason := ""
+		switch {
+		case len(c) == 0:
+			reason = "empty channel"
+		case duplicated:
+			reason = fmt.Sprintf("duplicated with #%d", j+1)
+		case !pattern.MatchString(c):
+			reason = "not matching " + pattern.String()
+		case duplicatedFileName:
+			reason = fmt.Sprintf("file name %s is duplicated with #%d", fileName, k+1)
+		}
+		if len(reason) != 0 {
+			invalid = append(invalid, InvalidChannel{i, c, reason})
+		}
+		if !duplicated {
+			seen[c] = i
+		}
+		if !duplicatedFileName {
+			seenFileNames[fileName] = i
+		}
+	}
+	if len(invalid) != 0 {
+		return &InvalidChannelsError{invalid}
+	}
+	return nil
+}
+
+// ChannelFileName returns the component of channel in the file names of channel apks.
+// The channel itself is written into apk as it is, while characters unsafe in file names,
+// i.e. path separators, characters reserved on Windows, spaces and control characters,
+// are replaced with '_'.
+func ChannelFileName(channel string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, channel)
+}
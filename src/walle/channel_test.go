@@ -0,0 +1,27 @@
+package walle
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateChannelsDefaultPattern(t *testing.T) {
+	valid := []string{"meituan", "google_play", "v1.0-beta", "美团", "華為 應用市場", "café", "a:b"}
+	if err := ValidateChannels(valid, nil); err != nil {
+		t.Errorf("valid channels are rejected, %s", err)
+	}
+	for _, c := range []string{"", "a/b", `a\b`, "a\tb", "a\nb", "a\x00b", "a\x7fb"} {
+		var e *InvalidChannelsError
+		if err := ValidateChannels([]string{c}, nil); !errors.As(err, &e) || len(e.Channels) != 1 {
+			t.Errorf("channel %q is not rejected, %v", c, err)
+		}
+	}
+}
+
+func TestValidateChannelsDuplicated(t *testing.T) {
+	var e *InvalidChannelsError
+	err := ValidateChannels([]string{"a", "b", "a", "c d", "c_d"}, nil)
+	if !errors.As(err, &e) || len(e.Channels) != 2 || e.Channels[0].Index != 2 || e.Channels[1].Index != 4 {
+		t.Errorf("duplicated channels are reported as %v", err)
+	}
+}
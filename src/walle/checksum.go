@@ -0,0 +1,152 @@
+package walle
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// supported checksum algorithms, names are the same as the extensions of coreutils tools
+var _CHECKSUM_ALGORITHMS = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha1":   sha1.New,
+	"md5":    md5.New,
+}
+
+// checksums computes digests of an output while it is being written.
+type checksums struct {
+	algorithms []string
+	hashes     []hash.Hash
+}
+
+// ValidateChecksumAlgorithms checks that every algorithm of GenerateOptions.Checksums is
+// supported: sha256, sha1 or md5.
+func ValidateChecksumAlgorithms(algorithms []string) error {
+	for _, a := range algorithms {
+		if _CHECKSUM_ALGORITHMS[a] == nil {
+			return fmt.Errorf("unsupported checksum algorithm %s, expect sha256, sha1 or md5", a)
+		}
+	}
+	return nil
+}
+
+// newChecksums returns checksums of algorithms, duplicated algorithms are computed once.
+func newChecksums(algorithms []string) *checksums {
+	c := new(checksums)
+	for _, a := range algorithms {
+		if c.hash(a) != nil {
+			continue
+		}
+		c.algorithms = append(c.algorithms, a)
+		c.hashes = append(c.hashes, _CHECKSUM_ALGORITHMS[a]())
+	}
+	return c
+}
+
+func (c *checksums) hash(algorithm string) hash.Hash {
+	for i, a := range c.algorithms {
+		if a == algorithm {
+			return c.hashes[i]
+		}
+	}
+	return nil
+}
+
+// sum returns the hex encoded digest of algorithm, empty if it is not computed.
+func (c *checksums) sum(algorithm string) string {
+	h := c.hash(algorithm)
+	if h == nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// checksumLine formats a line in the format of coreutils sha256sum etc.
+func checksumLine(sum, file string) string {
+	return sum + "  " + file + "\n"
+}
+
+// writeChecksumSidecars writes <output>.<algorithm> of every algorithm, which can be checked
+// by e.g. `sha256sum -c A.apk.sha256` in the dir of output.
+func writeChecksumSidecars(output string, sums *checksums, algorithms []string) error {
+	for _, a := range algorithms {
+		line := checksumLine(sums.sum(a), filepath.Base(output))
+		if err := writeFileBytes(output+"."+a, []byte(line)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checksumsFileName returns e.g. SHA256SUMS for sha256.
+func checksumsFileName(algorithm string) string {
+	return strings.ToUpper(algorithm) + "SUMS"
+}
+
+// writeChecksumsFiles writes <ALGORITHM>SUMS of outputs into dir of every algorithm,
+// sums holds checksums of each output.
+//
+// An existing <ALGORITHM>SUMS is merged rather than overwritten, so that runs generating
+// into the same dir, e.g. of several input apks, add up to one list: lines of outputs are
+// replaced, the others are kept in order, and lines of new outputs are appended.
+func writeChecksumsFiles(dir string, outputs []string, sums []*checksums, algorithms []string) error {
+	for _, a := range algorithms {
+		file := filepath.Join(dir, checksumsFileName(a))
+		lines := make(map[string]string, len(outputs))
+		for i, output := range outputs {
+			lines[filepath.Base(output)] = checksumLine(sums[i].sum(a), filepath.Base(output))
+		}
+		var b strings.Builder
+		data, err := os.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, line := range strings.SplitAfter(string(data), "\n") {
+			if len(line) == 0 {
+				continue
+			}
+			if name, ok := checksumLineFile(line); ok {
+				if l, ok := lines[name]; ok {
+					b.WriteString(l)
+					delete(lines, name)
+					continue
+				}
+			}
+			b.WriteString(line)
+			if !strings.HasSuffix(line, "\n") {
+				b.WriteByte('\n')
+			}
+		}
+		for _, output := range outputs {
+			if l, ok := lines[filepath.Base(output)]; ok {
+				b.WriteString(l)
+				delete(lines, filepath.Base(output))
+			}
+		}
+		if err = writeFileBytes(file, []byte(b.String())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checksumLineFile returns the file of a line in the format of coreutils sha256sum etc.,
+// false if line is not in the format, e.g. a comment.
+func checksumLineFile(line string) (string, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	i := strings.IndexByte(line, ' ')
+	// file follows "  " in text mode, or " *" in binary mode
+	if i <= 0 || i+2 > len(line) || (line[i+1] != ' ' && line[i+1] != '*') {
+		return "", false
+	}
+	if _, err := hex.DecodeString(line[:i]); err != nil {
+		return "", false
+	}
+	return line[i+2:], true
+}
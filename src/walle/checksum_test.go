@@ -0,0 +1,128 @@
+package walle
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateChecksums(t *testing.T) {
+	dir := t.TempDir()
+	base := testSignedApk(t, dir)
+	out := filepath.Join(dir, "out")
+	if err := os.Mkdir(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// SHA256SUMS of an earlier run, with a stale line of an output of this run
+	earlier := "# earlier run\n" +
+		"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef  other.apk\n" +
+		"0000000000000000000000000000000000000000000000000000000000000000  base-huawei.apk\n" +
+		"fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210 *binary.apk"
+	if err := os.WriteFile(filepath.Join(out, "SHA256SUMS"), []byte(earlier), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	infos := []ChannelInfo{{Channel: "meituan"}, {Channel: "huawei"}}
+	generated, err := Generate(context.Background(), base, out, infos, GenerateOptions{
+		Checksums: []string{"sha256", "md5", "sha256"}, ChecksumSidecar: true, ChecksumSums: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha256Lines, md5Lines := make([]string, len(generated)), make([]string, len(generated))
+	for i, g := range generated {
+		data, err := os.ReadFile(g.Output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Base(g.Output)
+		s, m := sha256.Sum256(data), md5.Sum(data)
+		sha256Lines[i] = hex.EncodeToString(s[:]) + "  " + name + "\n"
+		md5Lines[i] = hex.EncodeToString(m[:]) + "  " + name + "\n"
+		testFileContent(t, g.Output+".sha256", sha256Lines[i])
+		testFileContent(t, g.Output+".md5", md5Lines[i])
+		if _, err = os.Stat(g.Output + ".sha1"); !os.IsNotExist(err) {
+			t.Fatalf("sidecar of an algorithm not specified is written, %v", err)
+		}
+	}
+	testFileContent(t, filepath.Join(out, "MD5SUMS"), md5Lines[0]+md5Lines[1])
+	testFileContent(t, filepath.Join(out, "SHA256SUMS"), "# earlier run\n"+
+		"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef  other.apk\n"+
+		sha256Lines[1]+
+		"fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210 *binary.apk\n"+
+		sha256Lines[0])
+
+	// another run into the same dir adds up
+	if err = os.Rename(base, filepath.Join(dir, "next.apk")); err != nil {
+		t.Fatal(err)
+	}
+	next, err := Generate(context.Background(), filepath.Join(dir, "next.apk"), out, infos[:1], GenerateOptions{
+		Checksums: []string{"md5"}, ChecksumSums: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(next[0].Output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := md5.Sum(data)
+	testFileContent(t, filepath.Join(out, "MD5SUMS"), md5Lines[0]+md5Lines[1]+hex.EncodeToString(m[:])+"  next-meituan.apk\n")
+	if _, err = os.Stat(next[0].Output + ".md5"); !os.IsNotExist(err) {
+		t.Fatalf("sidecar is written without ChecksumSidecar, %v", err)
+	}
+
+	if _, err = Generate(context.Background(), filepath.Join(dir, "next.apk"), out, infos, GenerateOptions{
+		Checksums: []string{"sha512"}, ChecksumSums: true,
+	}); err == nil {
+		t.Fatal("generated with an unsupported checksum algorithm")
+	}
+}
+
+func testFileContent(t *testing.T, file, want string) {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Fatalf("%s is\n%s\nwant\n%s", file, data, want)
+	}
+}
+
+func TestChecksumLineFile(t *testing.T) {
+	tests := []struct {
+		line string
+		file string
+		ok   bool
+	}{
+		{"d41d8cd98f00b204e9800998ecf8427e  a.apk\n", "a.apk", true},
+		{"d41d8cd98f00b204e9800998ecf8427e *a.apk\r\n", "a.apk", true},
+		{"d41d8cd98f00b204e9800998ecf8427e  a b.apk", "a b.apk", true},
+		{"# comment\n", "", false},
+		{"d41d8cd98f00b204e9800998ecf8427e\n", "", false},
+		{"d41d8cd98f00b204e9800998ecf8427e a.apk\n", "", false},
+		{"not-hex  a.apk\n", "", false},
+		{"  a.apk\n", "", false},
+	}
+	for _, tt := range tests {
+		if file, ok := checksumLineFile(tt.line); file != tt.file || ok != tt.ok {
+			t.Errorf("checksumLineFile(%q) = %q, %v, want %q, %v", tt.line, file, ok, tt.file, tt.ok)
+		}
+	}
+}
+
+func TestValidateChecksumAlgorithms(t *testing.T) {
+	if err := ValidateChecksumAlgorithms([]string{"sha256", "sha1", "md5"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range [][]string{{"sha512"}, {"sha256", ""}, {"SHA256"}} {
+		if err := ValidateChecksumAlgorithms(a); err == nil {
+			t.Errorf("%q is valid", a)
+		}
+	}
+}
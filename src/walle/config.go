@@ -0,0 +1,79 @@
+package walle
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// ChannelConfig is the channel config file of walle, the same format as the one used by
+// `walle-cli batch2 -f` of Java walle:
+//
+//	{
+//	  "defaultExtraInfo": {"key": "value"},
+//	  "channelInfoList": [
+//	    {"channel": "meituan", "alias": "美团", "extraInfo": {"key": "value1"}},
+//	    {"channel": "samsung", "excludeDefaultExtraInfo": true}
+//	  ]
+//	}
+type ChannelConfig struct {
+	DefaultExtraInfo map[string]string    `json:"defaultExtraInfo"`
+	ChannelInfoList  []ChannelConfigEntry `json:"channelInfoList"`
+}
+
+// ChannelConfigEntry is a channel in ChannelConfig.
+type ChannelConfigEntry struct {
+	Channel                 string            `json:"channel"`
+	Alias                   string            `json:"alias"`
+	ExtraInfo               map[string]string `json:"extraInfo"`
+	ExcludeDefaultExtraInfo bool              `json:"excludeDefaultExtraInfo"`
+}
+
+// ReadChannelConfig reads the channel config from json file.
+func ReadChannelConfig(file string) (*ChannelConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	c := new(ChannelConfig)
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("cannot parse channel config %s, %s", file, err)
+	}
+	if len(c.ChannelInfoList) == 0 {
+		return nil, fmt.Errorf("no channel in channel config %s", file)
+	}
+	return c, nil
+}
+
+// ChannelInfos returns the channels with their extras in config, the extras of a channel
+// are merged into the default extras unless excludeDefaultExtraInfo is true.
+func (c *ChannelConfig) ChannelInfos() []ChannelInfo {
+	infos := make([]ChannelInfo, 0, len(c.ChannelInfoList))
+	for _, e := range c.ChannelInfoList {
+		extras := make(map[string]string)
+		if !e.ExcludeDefaultExtraInfo {
+			for k, v := range c.DefaultExtraInfo {
+				extras[k] = v
+			}
+		}
+		for k, v := range e.ExtraInfo {
+			extras[k] = v
+		}
+		if len(extras) == 0 {
+			extras = nil
+		}
+		infos = append(infos, ChannelInfo{Channel: e.Channel, Extras: extras})
+	}
+	return infos
+}
+
+// Aliases returns aliases of channels in config, keyed by channel.
+func (c *ChannelConfig) Aliases() map[string]string {
+	aliases := make(map[string]string)
+	for _, e := range c.ChannelInfoList {
+		if len(e.Alias) != 0 {
+			aliases[e.Channel] = e.Alias
+		}
+	}
+	return aliases
+}
@@ -0,0 +1,77 @@
+package walle
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadChannelConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.json")
+	data := `{
+  "defaultExtraInfo": {"key": "default", "other": "o"},
+  "channelInfoList": [
+    {"channel": "meituan", "alias": "美团", "extraInfo": {"key": "value1"}},
+    {"channel": "samsung", "excludeDefaultExtraInfo": true},
+    {"channel": "huawei", "excludeDefaultExtraInfo": true, "extraInfo": {"k": "v"}},
+    {"channel": "vivo"}
+  ]
+}`
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadChannelConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ChannelInfo{
+		{Channel: "meituan", Extras: map[string]string{"key": "value1", "other": "o"}},
+		{Channel: "samsung"},
+		{Channel: "huawei", Extras: map[string]string{"k": "v"}},
+		{Channel: "vivo", Extras: map[string]string{"key": "default", "other": "o"}},
+	}
+	if got := c.ChannelInfos(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ChannelInfos() = %v, want %v", got, want)
+	}
+	if got, want := c.Aliases(), map[string]string{"meituan": "美团"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Aliases() = %v, want %v", got, want)
+	}
+
+	// the extras of a channel never change the default ones
+	c.ChannelInfos()[3].Extras["key"] = "changed"
+	if c.DefaultExtraInfo["key"] != "default" {
+		t.Errorf("default extras are changed, %v", c.DefaultExtraInfo)
+	}
+}
+
+func TestReadChannelConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		data string // no file if empty
+		err  string
+	}{
+		{"missing", "", "no such file"},
+		{"not json", "channels: meituan", "cannot parse channel config"},
+		{"wrong type", `{"channelInfoList": {"channel": "meituan"}}`, "cannot parse channel config"},
+		{"no channel", `{"defaultExtraInfo": {"key": "value"}}`, "no channel"},
+		{"empty channel list", `{"channelInfoList": []}`, "no channel"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "_")+".json")
+			if len(tt.data) != 0 {
+				if err := os.WriteFile(file, []byte(tt.data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := ReadChannelConfig(file)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,406 @@
+package walle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// ApkDiff is the difference between two apks, see DiffApk.
+type ApkDiff struct {
+	Files [2]string `json:"files"`
+	// Identical is true if all parts below are the same, i.e. apks are byte-for-byte identical
+	Identical bool `json:"identical"`
+	// Content is the bytes before APK Signing Block, i.e. zip entries
+	Content    DiffSection `json:"content"`
+	CentralDir DiffSection `json:"centralDir"`
+	EOCD       []DiffField `json:"eocd"`
+	Entries    []DiffEntry `json:"signingBlock"`
+	Channel    []DiffField `json:"channel"`
+	// ChannelErrors are the errors of decoding the channel payload of each apk, empty if it
+	// is decoded or absent. A payload undecodable is left out of Channel.
+	ChannelErrors [2]string `json:"channelErrors"`
+}
+
+// DiffSection compares a section of two apks by size and SHA-256.
+type DiffSection struct {
+	Size   [2]int64  `json:"size"`
+	SHA256 [2]string `json:"sha256"`
+	Same   bool      `json:"same"`
+}
+
+// DiffField compares a named field of two apks, A or B is nil if the field is absent.
+type DiffField struct {
+	Name string  `json:"name"`
+	A    *string `json:"a"`
+	B    *string `json:"b"`
+	Same bool    `json:"same"`
+}
+
+// DiffEntry compares an ID-value pair in APK Signing Block of two apks.
+// A or B is nil if the pair is absent.
+type DiffEntry struct {
+	ID   string          `json:"id"`
+	Name string          `json:"name,omitempty"`
+	A    *DiffEntryValue `json:"a"`
+	B    *DiffEntryValue `json:"b"`
+	Same bool            `json:"same"`
+}
+
+// DiffEntryValue is the size and SHA-256 of value of an ID-value pair.
+type DiffEntryValue struct {
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// parsed apk for diff, an apk without APK Signing Block is fine
+type diffApk struct {
+	f                *os.File
+	contentSize      int64
+	centralDirSize   int64
+	centralDirSHA256 string
+	eocd             []byte
+	entries          []idValue
+	channel          map[string]string
+	channelErr       error
+}
+
+// DiffApk compares apk a and b: fields of EOCD, ID-value pairs in APK Signing Block,
+// channel payloads key by key, and whether the bytes before APK Signing Block and
+// central directory are identical.
+func DiffApk(a, b string) (*ApkDiff, error) {
+	da, err := openDiffApk(a)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse apk %s, %w", a, err)
+	}
+	defer da.f.Close()
+	db, err := openDiffApk(b)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse apk %s, %w", b, err)
+	}
+	defer db.f.Close()
+
+	d := &ApkDiff{Files: [2]string{a, b}}
+	if d.Content, err = diffSections(da.f, da.contentSize, db.f, db.contentSize); err != nil {
+		return nil, err
+	}
+	d.CentralDir = DiffSection{
+		Size:   [2]int64{da.centralDirSize, db.centralDirSize},
+		SHA256: [2]string{da.centralDirSHA256, db.centralDirSHA256},
+	}
+	d.CentralDir.Same = da.centralDirSHA256 == db.centralDirSHA256
+	d.EOCD = diffFields(eocdFields(da.eocd), eocdFields(db.eocd), eocdFieldNames)
+	d.Entries = diffEntries(da.entries, db.entries)
+	d.Channel = diffChannels(da.channel, db.channel)
+	for i, err := range []error{da.channelErr, db.channelErr} {
+		if err != nil {
+			d.ChannelErrors[i] = err.Error()
+		}
+	}
+
+	d.Identical = d.Content.Same && d.CentralDir.Same
+	for _, f := range d.EOCD {
+		d.Identical = d.Identical && f.Same
+	}
+	for _, e := range d.Entries {
+		d.Identical = d.Identical && e.Same
+	}
+	return d, nil
+}
+
+func openDiffApk(file string) (d *diffApk, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	eocd, eocdOffset, err := findEndOfCentralDirectoryRecord(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	if eocd == nil {
+		return nil, ErrNoEOCD
+	}
+	d = &diffApk{f: f, eocd: eocd}
+	centralDirOffset, centralDirSize, err := eocdCentralDirectory(eocd, eocdOffset)
+	if err != nil {
+		return nil, err
+	}
+	d.contentSize = int64(centralDirOffset)
+	block, offset, err := findApkSigningBlock(f, centralDirOffset)
+	switch {
+	case err == nil:
+		d.contentSize = offset
+		err = walkApkSigningBlock(block, func(id uint32, value []byte) {
+			d.entries = append(d.entries, idValue{id, value})
+		})
+		if err != nil {
+			return nil, err
+		}
+	case errors.Is(err, ErrNoSigningBlock):
+	default:
+		return nil, err
+	}
+	sum, err := hashSection(f, int64(centralDirOffset), int64(centralDirSize))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read central directory, %s", err)
+	}
+	d.centralDirSize = int64(centralDirSize)
+	d.centralDirSHA256 = hex.EncodeToString(sum)
+
+	d.channel, d.channelErr = channelOfEntries(d.entries)
+	return d, nil
+}
+
+// channelOfEntries returns the channel and extras read by the first codec of channelCodecs
+// having a pair in entries, nil if none. The error of a broken payload is returned along
+// with nil channel, which is reported in the diff rather than failing it.
+func channelOfEntries(entries []idValue) (map[string]string, error) {
+	for _, codec := range channelCodecs {
+		for _, e := range entries {
+			if e.id != codec.blockId() {
+				continue
+			}
+			c, err := codec.decode(e.value)
+			if err != nil {
+				return nil, fmt.Errorf("undecodable channel payload in %s, %w", codec.format(), err)
+			}
+			channel := map[string]string{"channel": c.Channel}
+			for k, v := range c.Extras {
+				channel[k] = v
+			}
+			return channel, nil
+		}
+	}
+	return nil, nil
+}
+
+func diffSections(a io.ReaderAt, sizeA int64, b io.ReaderAt, sizeB int64) (s DiffSection, err error) {
+	sa, err := hashSection(a, 0, sizeA)
+	if err != nil {
+		return
+	}
+	sb, err := hashSection(b, 0, sizeB)
+	if err != nil {
+		return
+	}
+	s.Size = [2]int64{sizeA, sizeB}
+	s.SHA256 = [2]string{hex.EncodeToString(sa), hex.EncodeToString(sb)}
+	s.Same = sizeA == sizeB && s.SHA256[0] == s.SHA256[1]
+	return
+}
+
+var eocdFieldNames = []string{
+	"disk number",
+	"central directory disk",
+	"central directory records on disk",
+	"central directory records",
+	"central directory size",
+	"central directory offset",
+	"comment length",
+	"comment",
+}
+
+func eocdFields(eocd []byte) map[string]string {
+	// fields out of eocd are 0
+	u16 := func(offset int) string {
+		v, _ := getUint16(eocd, offset)
+		return strconv.Itoa(int(v))
+	}
+	u32 := func(get func([]byte) (uint32, bool)) string {
+		v, _ := get(eocd)
+		return strconv.FormatUint(uint64(v), 10)
+	}
+	commentLength, _ := getUint16(eocd, _ZIP_EOCD_COMMENT_LENGTH_FIELD_OFFSET)
+	var comment []byte
+	if len(eocd) > _ZIP_EOCD_REC_MIN_SIZE {
+		comment = eocd[_ZIP_EOCD_REC_MIN_SIZE:]
+	}
+	if int(commentLength) < len(comment) {
+		comment = comment[:commentLength]
+	}
+	return map[string]string{
+		"disk number":                       u16(4),
+		"central directory disk":            u16(6),
+		"central directory records on disk": u16(8),
+		"central directory records":         u16(10),
+		"central directory size":            u32(getEocdCentralDirectorySize),
+		"central directory offset":          u32(getEocdCentralDirectoryOffset),
+		"comment length":                    strconv.Itoa(int(commentLength)),
+		"comment":                           strconv.Quote(string(comment)),
+	}
+}
+
+// diffFields compares fields of a and b in the order of names.
+func diffFields(a, b map[string]string, names []string) []DiffField {
+	fields := make([]DiffField, 0, len(names))
+	for _, name := range names {
+		f := DiffField{Name: name}
+		if v, ok := a[name]; ok {
+			f.A = &v
+		}
+		if v, ok := b[name]; ok {
+			f.B = &v
+		}
+		f.Same = (f.A == nil && f.B == nil) || (f.A != nil && f.B != nil && *f.A == *f.B)
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// diffChannels compares channel payloads key by key, "channel" goes first and then the others
+// in alphabetical order.
+func diffChannels(a, b map[string]string) []DiffField {
+	if a == nil && b == nil {
+		return nil
+	}
+	var keys []string
+	seen := make(map[string]bool)
+	for _, m := range []map[string]string{a, b} {
+		for k := range m {
+			if k != "channel" && !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return diffFields(a, b, append([]string{"channel"}, keys...))
+}
+
+// diffEntries compares ID-value pairs of a and b, pairs are matched by ID and the order of
+// occurrence if an ID appears more than once. Pairs are listed in the order of a, then the
+// ones only in b.
+func diffEntries(a, b []idValue) []DiffEntry {
+	type key struct {
+		id uint32
+		n  int
+	}
+	keysOf := func(pairs []idValue) []key {
+		count := make(map[uint32]int)
+		keys := make([]key, len(pairs))
+		for i, p := range pairs {
+			keys[i] = key{p.id, count[p.id]}
+			count[p.id]++
+		}
+		return keys
+	}
+	valueOf := func(p idValue) *DiffEntryValue {
+		sum := sha256.Sum256(p.value)
+		return &DiffEntryValue{Size: len(p.value), SHA256: hex.EncodeToString(sum[:])}
+	}
+	ka, kb := keysOf(a), keysOf(b)
+	inB := make(map[key]int)
+	for i, k := range kb {
+		inB[k] = i
+	}
+	var entries []DiffEntry
+	matched := make(map[key]bool)
+	for i, k := range ka {
+		e := DiffEntry{ID: fmt.Sprintf("0x%08x", k.id), Name: SigningBlockIdName(k.id), A: valueOf(a[i])}
+		if j, ok := inB[k]; ok {
+			e.B = valueOf(b[j])
+			matched[k] = true
+		}
+		e.Same = e.B != nil && *e.A == *e.B
+		entries = append(entries, e)
+	}
+	for j, k := range kb {
+		if !matched[k] {
+			entries = append(entries, DiffEntry{ID: fmt.Sprintf("0x%08x", k.id), Name: SigningBlockIdName(k.id), B: valueOf(b[j])})
+		}
+	}
+	return entries
+}
+
+// Text returns the difference in readable text, only different parts are listed unless all is true.
+func (d *ApkDiff) Text(all bool) string {
+	var buf []byte
+	printf := func(format string, v ...interface{}) {
+		buf = append(buf, fmt.Sprintf(format, v...)...)
+	}
+	printf("--- %s\n+++ %s\n", d.Files[0], d.Files[1])
+	section := func(name string, s DiffSection) {
+		if s.Same {
+			printf("  %s: identical (%d bytes)\n", name, s.Size[0])
+		} else {
+			printf("! %s: differ\n", name)
+			printf("    - %d bytes, sha256 %s\n", s.Size[0], s.SHA256[0])
+			printf("    + %d bytes, sha256 %s\n", s.Size[1], s.SHA256[1])
+		}
+	}
+	fields := func(name string, fields []DiffField) {
+		printf("%s:\n", name)
+		for _, f := range fields {
+			if f.Same {
+				if all && f.A != nil {
+					printf("    %s: %s\n", f.Name, *f.A)
+				}
+				continue
+			}
+			printf("  ! %s:\n", f.Name)
+			printf("    - %s\n", optional(f.A))
+			printf("    + %s\n", optional(f.B))
+		}
+	}
+	section("content before APK Signing Block", d.Content)
+	section("central directory", d.CentralDir)
+	fields("EOCD", d.EOCD)
+	printf("APK Signing Block:\n")
+	if len(d.Entries) == 0 {
+		printf("    (absent)\n")
+	}
+	for _, e := range d.Entries {
+		name := e.ID
+		if len(e.Name) != 0 {
+			name += " (" + e.Name + ")"
+		}
+		value := func(v *DiffEntryValue) string {
+			if v == nil {
+				return "(absent)"
+			}
+			return fmt.Sprintf("%d bytes, sha256 %s", v.Size, v.SHA256)
+		}
+		if e.Same {
+			if all {
+				printf("    %s: %s\n", name, value(e.A))
+			}
+			continue
+		}
+		printf("  ! %s:\n", name)
+		printf("    - %s\n", value(e.A))
+		printf("    + %s\n", value(e.B))
+	}
+	if d.Channel != nil {
+		fields("channel", d.Channel)
+	}
+	for i, sign := range []string{"-", "+"} {
+		if len(d.ChannelErrors[i]) != 0 {
+			printf("! channel %s %s\n", sign, d.ChannelErrors[i])
+		}
+	}
+	if d.Identical {
+		printf("apks are identical\n")
+	}
+	return string(buf)
+}
+
+func optional(s *string) string {
+	if s == nil {
+		return "(absent)"
+	}
+	return *s
+}
@@ -0,0 +1,118 @@
+package walle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChannelOfEntries(t *testing.T) {
+	v2 := idValue{APK_SIGNATURE_SCHEME_V2_BLOCK_ID, []byte("v2")}
+	walle := idValue{APK_CHANNEL_BLOCK_ID, []byte(`{"channel":"a","k":"v"}`)}
+	vasDolly := idValue{APK_VASDOLLY_CHANNEL_BLOCK_ID, []byte("b")}
+	broken := idValue{APK_CHANNEL_BLOCK_ID, []byte(`{"channel":`)}
+
+	tests := []struct {
+		entries []idValue
+		want    map[string]string
+	}{
+		{[]idValue{v2}, nil},
+		{[]idValue{v2, walle}, map[string]string{"channel": "a", "k": "v"}},
+		{[]idValue{vasDolly, walle}, map[string]string{"channel": "a", "k": "v"}},
+		{[]idValue{v2, vasDolly}, map[string]string{"channel": "b"}},
+	}
+	for _, tt := range tests {
+		if got, err := channelOfEntries(tt.entries); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("channelOfEntries(%v) = %v, %v, want %v", tt.entries, got, err, tt.want)
+		}
+	}
+
+	got, err := channelOfEntries([]idValue{v2, broken, vasDolly})
+	if got != nil || !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("channel of broken payload is %v, %v, want %v", got, err, ErrInvalidPayload)
+	}
+}
+
+func TestDiffApkUndecodableChannel(t *testing.T) {
+	dir := t.TempDir()
+	base := testSignedApk(t, dir)
+	a := filepath.Join(dir, "a.apk")
+	if _, err := Generate(context.Background(), base, dir, []ChannelInfo{{Channel: "a", Extras: map[string]string{"k": "v"}}}, GenerateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "base-a.apk"), a); err != nil {
+		t.Fatal(err)
+	}
+	// b has a broken payload in place of the channel of a
+	data, err := os.ReadFile(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := newZipSections(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken, err := rebuildTransform(func(signingBlock []byte) ([]byte, int, error) {
+		return rebuildSigningBlock(signingBlock, func(uint32) bool { return true },
+			idValue{APK_CHANNEL_BLOCK_ID, []byte(`{"channel":`)})
+	})(&z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bData, err := io.ReadAll(broken.reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := filepath.Join(dir, "b.apk")
+	if err = os.WriteFile(b, bData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := DiffApk(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Identical {
+		t.Fatal("apks are identical")
+	}
+	if len(d.ChannelErrors[0]) != 0 || !strings.Contains(d.ChannelErrors[1], "undecodable") {
+		t.Fatalf("channel errors %q", d.ChannelErrors)
+	}
+	for _, f := range d.Channel {
+		if f.A == nil || f.B != nil || f.Same {
+			t.Errorf("channel field %s of broken payload is not absent, %+v", f.Name, f)
+		}
+	}
+	out, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m struct {
+		ChannelErrors []string `json:"channelErrors"`
+		Channel       []struct {
+			Name string  `json:"name"`
+			B    *string `json:"b"`
+		} `json:"channel"`
+	}
+	if err = json.Unmarshal(out, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.ChannelErrors) != 2 || len(m.ChannelErrors[0]) != 0 || len(m.ChannelErrors[1]) == 0 {
+		t.Fatalf("channelErrors in json %q", m.ChannelErrors)
+	}
+	for _, f := range m.Channel {
+		if f.B != nil {
+			t.Fatalf("error is in channel field %s of json, %q", f.Name, *f.B)
+		}
+	}
+	if text := d.Text(false); !strings.Contains(text, "! channel + "+d.ChannelErrors[1]) {
+		t.Fatalf("error is not in text\n%s", text)
+	}
+}
@@ -0,0 +1,73 @@
+package walle
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors of parsing apks, returned errors wrap them and can be tested by errors.Is.
+var (
+	// ErrNoEOCD means the End of Central Directory record is not found, i.e. not a zip file.
+	ErrNoEOCD = errors.New("cannot find EOCD record, maybe a broken zip file")
+	// ErrNoSigningBlock means there is no APK Signing Block, i.e. not signed with v2 or later.
+	ErrNoSigningBlock = errors.New("no APK Signing Block before ZIP Central Directory")
+	// ErrCorruptSigningBlock means the APK Signing Block is broken, see CorruptSigningBlockError.
+	ErrCorruptSigningBlock = errors.New("APK Signing Block is corrupt")
+	// ErrNoChannel means no channel is written into the apk.
+	ErrNoChannel = errors.New("no channel block in APK Signing Block")
+	// ErrInvalidPayload means the payload of the channel block is not a json object of strings.
+	ErrInvalidPayload = errors.New("invalid channel payload")
+)
+
+// CorruptSigningBlockError reports where the APK Signing Block is broken.
+// errors.Is(err, ErrCorruptSigningBlock) is true for it.
+type CorruptSigningBlockError struct {
+	Entry  int // number of the broken ID-value pair starting from 1, 0 if the block itself is broken
+	Reason string
+}
+
+func (e *CorruptSigningBlockError) Error() string {
+	if e.Entry == 0 {
+		return fmt.Sprintf("APK Signing Block is corrupt, %s", e.Reason)
+	}
+	return fmt.Sprintf("APK Signing Block broken on entry #%d, %s", e.Entry, e.Reason)
+}
+
+func (e *CorruptSigningBlockError) Is(target error) bool {
+	return target == ErrCorruptSigningBlock
+}
+
+func corruptSigningBlock(entry int, format string, v ...interface{}) error {
+	return &CorruptSigningBlockError{entry, fmt.Sprintf(format, v...)}
+}
+
+// Exit codes of walle-cli, by which scripts can tell failures apart.
+const (
+	ExitError               = 1 // any other error, or apks differ on diff
+	ExitUsage               = 2 // invalid flags, or any error of diff, as GNU diff does
+	ExitNoEOCD              = 3
+	ExitNoSigningBlock      = 4
+	ExitCorruptSigningBlock = 5
+	ExitNoChannel           = 6
+	ExitInvalidPayload      = 7
+	ExitInterrupted         = 130 // 128 + SIGINT, as shells do
+)
+
+// ExitCode returns the exit code of walle-cli for err, 0 if err is nil.
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, ErrNoEOCD):
+		return ExitNoEOCD
+	case errors.Is(err, ErrNoSigningBlock):
+		return ExitNoSigningBlock
+	case errors.Is(err, ErrCorruptSigningBlock):
+		return ExitCorruptSigningBlock
+	case errors.Is(err, ErrNoChannel):
+		return ExitNoChannel
+	case errors.Is(err, ErrInvalidPayload):
+		return ExitInvalidPayload
+	}
+	return ExitError
+}
@@ -0,0 +1,282 @@
+package walle
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ParseExtras parses extras in the form of key value pairs, e.g.
+//
+//	thing=test,boom=1
+//	url="https://example.com/?a=1&b=2",name='a, b'
+//	path=C:\\foo\,bar
+//
+// Pairs are split by ',' and key value are split by the first '='. Both key and value may be
+// quoted by double or single quotes, or contain characters escaped by backslash, to hold ','
+// or '='. Escapes are resolved in double quotes too, but not in single quotes.
+// A quote starts quoting only at the start of a key or value, elsewhere it is kept as it is,
+// e.g. note=it's is the value it's.
+// Unquoted spaces around keys and values are trimmed, empty pairs are ignored.
+// Key channel is reserved for the channel itself.
+//
+// If s starts with '@', extras are read from the file following it instead, see ReadExtrasFile.
+func ParseExtras(s string) (map[string]string, error) {
+	if strings.HasPrefix(s, "@") {
+		return ReadExtrasFile(s[1:])
+	}
+	extras := make(map[string]string)
+	p := &extrasParser{s: s}
+	for n := 1; !p.end(); n++ {
+		key, err := p.token(true)
+		if err != nil {
+			return nil, err
+		}
+		if p.end() || p.s[p.pos] == ',' {
+			p.pos++
+			if len(key) == 0 {
+				continue // empty pair
+			}
+			return nil, fmt.Errorf("missing '=' in pair #%d %q of extras", n, key)
+		}
+		p.pos++ // '='
+		value, err := p.token(false)
+		if err != nil {
+			return nil, err
+		}
+		p.pos++ // ','
+		if err = addExtra(extras, key, value); err != nil {
+			return nil, fmt.Errorf("%s in pair #%d of extras", err, n)
+		}
+	}
+	return extras, nil
+}
+
+// ReadExtrasFile reads extras from file:
+//   - *.json, an object of string values, e.g. {"thing": "test", "boom": "1"}
+//   - *.properties, in the format of Java properties, e.g. thing=test
+func ReadExtrasFile(file string) (map[string]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var extras map[string]string
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		extras, err = parseExtrasJSON(data)
+	case ".properties":
+		extras, err = parseExtrasProperties(data)
+	default:
+		return nil, fmt.Errorf("unsupported extras file %s, expect *.json or *.properties", file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse extras file %s, %s", file, err)
+	}
+	return extras, nil
+}
+
+func addExtra(extras map[string]string, key, value string) error {
+	if len(key) == 0 {
+		return fmt.Errorf("empty key")
+	}
+	if key == "channel" {
+		return fmt.Errorf("key channel is reserved")
+	}
+	extras[key] = value
+	return nil
+}
+
+type extrasParser struct {
+	s   string
+	pos int
+}
+
+func (p *extrasParser) end() bool {
+	return p.pos >= len(p.s)
+}
+
+// token reads a key if isKey is true, which ends before unquoted and unescaped '=' or ',',
+// or a value, which ends before ','. Quotes at the start and escapes are resolved.
+func (p *extrasParser) token(isKey bool) (string, error) {
+	var b strings.Builder
+	literal := 0 // length of b until the last quoted or escaped character, which is never trimmed
+	for ; !p.end(); p.pos++ {
+		c := p.s[p.pos]
+		switch {
+		case c == ',' || (isKey && c == '='):
+			return trimToken(b.String(), literal), nil
+		case c == '\\':
+			if p.pos+1 >= len(p.s) {
+				return "", fmt.Errorf("dangling '\\' at the end of extras")
+			}
+			p.pos++
+			b.WriteByte(p.s[p.pos])
+			literal = b.Len()
+		case (c == '"' || c == '\'') && b.Len() == 0 && literal == 0:
+			start := p.pos
+			for p.pos++; ; p.pos++ {
+				if p.end() {
+					return "", fmt.Errorf("unterminated quote at offset %d of extras", start)
+				}
+				q := p.s[p.pos]
+				if q == c {
+					break
+				}
+				// escapes are resolved in double quotes only
+				if q == '\\' && c == '"' && p.pos+1 < len(p.s) {
+					p.pos++
+					q = p.s[p.pos]
+				}
+				b.WriteByte(q)
+			}
+			literal = b.Len()
+		case b.Len() == 0 && isBlank(c):
+			// leading spaces
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return trimToken(b.String(), literal), nil
+}
+
+// trimToken trims trailing spaces of token after literal.
+func trimToken(token string, literal int) string {
+	return token[:literal] + strings.TrimRight(token[literal:], " \t")
+}
+
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\f'
+}
+
+func parseExtrasJSON(data []byte) (map[string]string, error) {
+	var values map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&values); err != nil {
+		return nil, err
+	}
+	extras := make(map[string]string)
+	for k, v := range values {
+		var value string
+		switch v := v.(type) {
+		case string:
+			value = v
+		case json.Number:
+			value = v.String()
+		case bool:
+			value = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("value of key %s must be a string, a number or a boolean", k)
+		}
+		if err := addExtra(extras, k, value); err != nil {
+			return nil, err
+		}
+	}
+	return extras, nil
+}
+
+// parseExtrasProperties parses data in the format of java.util.Properties: '#' and '!' start
+// comments, key and value are split by '=', ':' or spaces, a line ends with '\' is continued
+// by the next line, and escapes include \t, \n, \r, \f and \uXXXX.
+func parseExtrasProperties(data []byte) (map[string]string, error) {
+	extras := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimLeft(scanner.Text(), " \t\f")
+		if len(line) == 0 || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+		for continued(line) && scanner.Scan() {
+			n++
+			line = line[:len(line)-1] + strings.TrimLeft(scanner.Text(), " \t\f")
+		}
+		key, value, err := splitProperty(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s on line %d", err, n)
+		}
+		if err = addExtra(extras, key, value); err != nil {
+			return nil, fmt.Errorf("%s on line %d", err, n)
+		}
+	}
+	return extras, scanner.Err()
+}
+
+// a line is continued if it ends with odd number of '\'
+func continued(line string) bool {
+	n := 0
+	for i := len(line) - 1; i >= 0 && line[i] == '\\'; i-- {
+		n++
+	}
+	return n%2 == 1
+}
+
+func splitProperty(line string) (key, value string, err error) {
+	i := 0
+	for ; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' {
+			i++
+			continue
+		}
+		if c == '=' || c == ':' || isBlank(c) {
+			break
+		}
+	}
+	if i > len(line) {
+		i = len(line)
+	}
+	rest := strings.TrimLeft(line[i:], " \t\f")
+	if len(rest) != 0 && (rest[0] == '=' || rest[0] == ':') {
+		rest = strings.TrimLeft(rest[1:], " \t\f")
+	}
+	if key, err = unescapeProperty(line[:i]); err != nil {
+		return
+	}
+	value, err = unescapeProperty(rest)
+	return
+}
+
+func unescapeProperty(s string) (string, error) {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 >= len(s) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch c = s[i]; c {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u':
+			if i+4 >= len(s) {
+				return "", fmt.Errorf("malformed \\uXXXX escape")
+			}
+			r, err := strconv.ParseUint(s[i+1:i+5], 16, 16)
+			if err != nil {
+				return "", fmt.Errorf("malformed \\uXXXX escape")
+			}
+			b.WriteRune(rune(r))
+			i += 4
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
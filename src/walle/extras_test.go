@@ -0,0 +1,40 @@
+package walle
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseExtras(t *testing.T) {
+	tests := []struct {
+		s    string
+		want map[string]string
+	}{
+		{"thing=test,boom=1", map[string]string{"thing": "test", "boom": "1"}},
+		{` a = 1 ,, b= 2 `, map[string]string{"a": "1", "b": "2"}},
+		{`url="https://example.com/?a=1&b=2",name='a, b'`, map[string]string{"url": "https://example.com/?a=1&b=2", "name": "a, b"}},
+		{`path=C:\\foo\,bar`, map[string]string{"path": `C:\foo,bar`}},
+		{`a="x\"y",b='x\y'`, map[string]string{"a": `x"y`, "b": `x\y`}},
+		{`a=" padded "`, map[string]string{"a": " padded "}},
+		{"note=it's", map[string]string{"note": "it's"}},
+		{`title=say "hi",n=5'10"`, map[string]string{"title": `say "hi"`, "n": `5'10"`}},
+		{"don't=1", map[string]string{"don't": "1"}},
+		{"a=", map[string]string{"a": ""}},
+	}
+	for _, tt := range tests {
+		got, err := ParseExtras(tt.s)
+		if err != nil {
+			t.Errorf("ParseExtras(%q) returns %s", tt.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseExtras(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+
+	for _, s := range []string{`a="unterminated`, `a='b,c`, `a=b\`, "a", "=1", "channel=x"} {
+		if _, err := ParseExtras(s); err == nil {
+			t.Errorf("ParseExtras(%q) returns no error", s)
+		}
+	}
+}
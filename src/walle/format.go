@@ -0,0 +1,105 @@
+package walle
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ChannelFormat is the format in which a channel is written into APK Signing Block.
+type ChannelFormat string
+
+const (
+	// FormatWalle writes the channel and extras as a json object under APK_CHANNEL_BLOCK_ID.
+	FormatWalle ChannelFormat = "walle"
+	// FormatVasDolly writes the channel in UTF-8 under APK_VASDOLLY_CHANNEL_BLOCK_ID, as
+	// Tencent VasDolly does, extras are not supported.
+	FormatVasDolly ChannelFormat = "vasdolly"
+	// FormatPackerNg writes the channel and extras as key/value pairs under
+	// APK_PACKER_NG_CHANNEL_BLOCK_ID, as packer-ng-plugin does.
+	FormatPackerNg ChannelFormat = "packerng"
+)
+
+// channelCodec encodes channel info into the value of an ID-value pair of APK Signing Block
+// in its format, and decodes it. A new format is added by a codec in channelCodecs.
+type channelCodec interface {
+	format() ChannelFormat
+	// blockId returns ID of the ID-value pair holding the channel.
+	blockId() uint32
+	// encode returns the value holding info, or an error if info cannot be written in it.
+	encode(info ChannelInfo) ([]byte, error)
+	// decode returns the channel info in value, the error wraps ErrInvalidPayload if value
+	// is broken.
+	decode(value []byte) (ChannelInfo, error)
+}
+
+// channelCodecs are the codecs by which channels are read, in order of precedence.
+var channelCodecs = []channelCodec{walleCodec{}, vasDollyCodec{}, packerNgCodec{}}
+
+// channelBlockIds returns IDs of the ID-value pairs holding channels in any format.
+func channelBlockIds() []uint32 {
+	ids := make([]uint32, len(channelCodecs))
+	for i, c := range channelCodecs {
+		ids[i] = c.blockId()
+	}
+	return ids
+}
+
+// ParseChannelFormat returns the format named s, FormatWalle if s is empty.
+func ParseChannelFormat(s string) (ChannelFormat, error) {
+	c, err := codecOf(ChannelFormat(s))
+	if err != nil {
+		return "", err
+	}
+	return c.format(), nil
+}
+
+// codecOf returns the codec of format f, the one of FormatWalle if f is empty.
+func codecOf(f ChannelFormat) (channelCodec, error) {
+	if len(f) == 0 {
+		f = FormatWalle
+	}
+	names := make([]string, len(channelCodecs))
+	for i, c := range channelCodecs {
+		if c.format() == f {
+			return c, nil
+		}
+		names[i] = string(c.format())
+	}
+	return nil, fmt.Errorf("unknown channel format %s, it must be one of %v", f, names)
+}
+
+// codecOfBlockId returns the codec of the ID-value pair of id, false if it holds no channel.
+func codecOfBlockId(id uint32) (channelCodec, bool) {
+	for _, c := range channelCodecs {
+		if c.blockId() == id {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// walleCodec is the codec of FormatWalle, see ChannelInfo.Bytes.
+type walleCodec struct{}
+
+func (walleCodec) format() ChannelFormat {
+	return FormatWalle
+}
+
+func (walleCodec) blockId() uint32 {
+	return APK_CHANNEL_BLOCK_ID
+}
+
+func (walleCodec) encode(info ChannelInfo) ([]byte, error) {
+	return info.Bytes(), nil
+}
+
+func (walleCodec) decode(value []byte) (c ChannelInfo, err error) {
+	var bundle map[string]string
+	if err = json.Unmarshal(value, &bundle); err != nil {
+		return c, fmt.Errorf("%w, %s", ErrInvalidPayload, err)
+	}
+	c.Channel = bundle["channel"]
+	delete(bundle, "channel")
+	c.Extras = bundle
+	return c, nil
+}
@@ -2,37 +2,45 @@ package walle
 
 import (
 	"os"
-	"fmt"
+	"io"
 	"path/filepath"
 )
 
 func isRegularFile(f string) bool {
 	fi, err := os.Stat(f)
-	if err != nil && !fi.Mode().IsRegular() {
-		return false
-	}
-	return true
+	return err == nil && fi.Mode().IsRegular()
 }
 
-//LittleEndian
-func getUint16(b []byte, offset int) uint16 {
-	_ = b[offset+1] // early bounds check
+// inBounds reports whether b holds n bytes at offset.
+func inBounds(b []byte, offset, n int) bool {
+	return offset >= 0 && offset <= len(b)-n
+}
+
+//LittleEndian, ok is false if b has no 2 bytes at offset
+func getUint16(b []byte, offset int) (v uint16, ok bool) {
+	if !inBounds(b, offset, 2) {
+		return 0, false
+	}
 	return uint16(b[offset+0]) |
-		uint16(b[offset+1])<<8
+		uint16(b[offset+1])<<8, true
 }
 
-//LittleEndian
-func getUint32(b []byte, offset int) uint32 {
-	_ = b[offset+3] // early bounds check
+//LittleEndian, ok is false if b has no 4 bytes at offset
+func getUint32(b []byte, offset int) (v uint32, ok bool) {
+	if !inBounds(b, offset, 4) {
+		return 0, false
+	}
 	return uint32(b[offset+0]) |
 		uint32(b[offset+1])<<8 |
 		uint32(b[offset+2])<<16 |
-		uint32(b[offset+3])<<24
+		uint32(b[offset+3])<<24, true
 }
 
-//LittleEndian
-func getUint64(b []byte, offset int) uint64 {
-	_ = b[offset+7] // bounds check hint to compiler; see golang.org/issue/14808
+//LittleEndian, ok is false if b has no 8 bytes at offset
+func getUint64(b []byte, offset int) (v uint64, ok bool) {
+	if !inBounds(b, offset, 8) {
+		return 0, false
+	}
 	return uint64(b[offset+0]) |
 		uint64(b[offset+1])<<8 |
 		uint64(b[offset+2])<<16 |
@@ -40,7 +48,7 @@ func getUint64(b []byte, offset int) uint64 {
 		uint64(b[offset+4])<<32 |
 		uint64(b[offset+5])<<40 |
 		uint64(b[offset+6])<<48 |
-		uint64(b[offset+7])<<56
+		uint64(b[offset+7])<<56, true
 }
 
 //LittleEndian
@@ -72,28 +80,6 @@ func putUint16(v uint16, b []byte, offset int) {
 	b[offset+1] = byte(v >> 8)
 }
 
-func copyBytes(src []byte, srcStart int, dst []byte, dstStart int, count int) (int, error){
-	if len(src) < srcStart+count || len(dst) < dstStart+count {
-		return -1, fmt.Errorf("Array index out of bounds!")
-	}
-	for i := 0; i<count ; i++ {
-		dst[dstStart+i] = src[srcStart+i]
-	}
-	return count, nil
-}
-
-// Open file with function fp
-func openFile(file string, fp func(*os.File) (interface{}, error)) (ret interface{}, err error) {
-	var f *os.File
-	f, err = os.Open(file)
-	if err != nil {
-		return
-	}
-	defer f.Close()
-	return fp(f)
-}
-
-
 func fileNameAndExt(path string) (string, string) {
 	name := filepath.Base(path)
 	for i := len(name) - 1; i >= 0 && !os.IsPathSeparator(name[i]); i-- {
@@ -104,15 +90,68 @@ func fileNameAndExt(path string) (string, string) {
 	return name, ""
 }
 
-// exit is equivalent to fmt.Println() followed by a call to os.exit(1).
-func exit(v interface{}) {
-	fmt.Fprintln(os.Stderr, v)
-	os.Exit(1)
+// Report whether a and b describe the same existing file.
+func sameFile(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fa, fb)
+}
+
+// Write output atomically: content is written by write into a temp file in the same dir,
+// synced to disk and then renamed to output, so that output is either left untouched or
+// replaced by the complete content. The temp file is removed on error.
+func writeFile(output string, write func(w io.Writer) error) (err error) {
+	dir, name := filepath.Split(output)
+	if len(dir) == 0 {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	// an existing output keeps its permission
+	mode := os.FileMode(0644)
+	if fi, e := os.Stat(output); e == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err = f.Chmod(mode); err != nil {
+		return
+	}
+	if err = write(f); err != nil {
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(f.Name(), output); err != nil {
+		return
+	}
+	// persist the rename, not supported on some systems
+	if d, e := os.Open(dir); e == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
 }
 
-// exitf is equivalent to fmt.Printf() followed by a call to os.exit(1).
-func exitf(format string, v ...interface{}) {
-	fmt.Fprintf(os.Stderr, format, v...)
-	fmt.Fprintln(os.Stderr)
-	os.Exit(1)
+func writeFileBytes(output string, data []byte) error {
+	return writeFile(output, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
 }
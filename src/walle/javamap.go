@@ -0,0 +1,109 @@
+package walle
+
+import (
+	"sort"
+	"unicode/utf16"
+)
+
+// javaPayloadKeys returns keys of the channel payload in the order written by Java walle.
+//
+// The order targets Java walle 1.1.x (e.g. walle-cli 1.1.6) with org.json 20160810 on
+// Java 8 or later. Its ChannelWriter puts extras into a HashMap by putAll, then puts the
+// channel, and writes the map by JSONObject(Map), which copies it into new HashMap() of
+// the default capacity 16. Later org.json copies into new HashMap(map.size()) instead and
+// may order keys differently, e.g. channel,url,k rather than channel,k,url.
+// So keys are in the iteration order of java.util.HashMap, i.e. ordered by their buckets,
+// and by insertion within a bucket. Extras are sorted before putting, as the order of keys
+// colliding in a bucket is lost in a Go map.
+func javaPayloadKeys(channel string, extras map[string]string) []string {
+	keys := make([]string, 0, len(extras)+1)
+	for k := range extras {
+		if k != "channel" { // removed from extras by Java walle
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	// HashMap.putAll on an empty map sizes its table for the entries first
+	data := newJavaHashMap(16)
+	if len(keys) != 0 {
+		data = newJavaHashMap(javaTableSizeFor(int(float32(len(keys))/0.75 + 1)))
+	}
+	for _, k := range keys {
+		data.put(k)
+	}
+	if len(channel) != 0 {
+		data.put("channel")
+	}
+
+	// new JSONObject(map) puts entries into new HashMap()
+	object := newJavaHashMap(16)
+	for _, k := range data.keys() {
+		object.put(k)
+	}
+	return object.keys()
+}
+
+// javaHashMap simulates where String keys are in java.util.HashMap of Java 8 or later.
+// The table of HashMap is doubled once its size exceeds 3/4 of capacity, or a bucket
+// holds more than 8 keys while capacity is less than 64. Buckets turned into trees, which
+// needs more than 8 keys colliding in a table of 64 or more, are not simulated.
+type javaHashMap struct {
+	capacity int
+	inserted []string
+}
+
+func newJavaHashMap(capacity int) *javaHashMap {
+	return &javaHashMap{capacity: capacity}
+}
+
+func (m *javaHashMap) bucket(key string) int {
+	return int(javaHash(key) & uint32(m.capacity-1))
+}
+
+func (m *javaHashMap) put(key string) {
+	colliding := 0
+	for _, k := range m.inserted {
+		if k == key {
+			return
+		}
+		if m.bucket(k) == m.bucket(key) {
+			colliding++
+		}
+	}
+	m.inserted = append(m.inserted, key)
+	if colliding >= 8 && m.capacity < 64 {
+		m.capacity *= 2
+	}
+	if len(m.inserted) > m.capacity*3/4 {
+		m.capacity *= 2
+	}
+}
+
+// keys returns keys in the iteration order, resizing keeps the insertion order of keys
+// within a bucket.
+func (m *javaHashMap) keys() []string {
+	keys := append([]string(nil), m.inserted...)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return m.bucket(keys[i]) < m.bucket(keys[j])
+	})
+	return keys
+}
+
+// javaHash returns String.hashCode() of s spread as HashMap.hash() does.
+func javaHash(s string) uint32 {
+	var h uint32
+	for _, c := range utf16.Encode([]rune(s)) {
+		h = 31*h + uint32(c)
+	}
+	return h ^ (h >> 16)
+}
+
+// javaTableSizeFor returns the power of two capacity of HashMap for n, at least 1.
+func javaTableSizeFor(n int) int {
+	c := 1
+	for c < n {
+		c <<= 1
+	}
+	return c
+}
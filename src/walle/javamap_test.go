@@ -0,0 +1,121 @@
+package walle
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestJavaPayloadKeys(t *testing.T) {
+	tests := []struct {
+		channel string
+		extras  map[string]string
+		want    []string
+	}{
+		{"meituan", nil, []string{"channel"}},
+		{"", map[string]string{"k": "v"}, []string{"k"}},
+		{"meituan", map[string]string{"k": "v", "url": "u"}, []string{"channel", "k", "url"}},
+		{"meituan", map[string]string{"channel": "other", "k": "v"}, []string{"channel", "k"}},
+	}
+	for _, tt := range tests {
+		if got := javaPayloadKeys(tt.channel, tt.extras); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("javaPayloadKeys(%q, %v) = %v, want %v", tt.channel, tt.extras, got, tt.want)
+		}
+	}
+}
+
+// TestJavaWalleTails reads the channel of each tail in testdata/javawalle, i.e. the bytes
+// of an apk from APK Signing Block to the end, and writes it again into the tail without
+// the channel, which must reproduce the tail byte for byte. Tails must be cut from apks
+// written by Java walle-cli, see testdata/javawalle/README.md.
+func TestJavaWalleTails(t *testing.T) {
+	tails, err := filepath.Glob(filepath.Join("testdata", "javawalle", "*.tail"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tails) == 0 {
+		t.Skip("no tails written by Java walle-cli in testdata/javawalle")
+	}
+	for _, tail := range tails {
+		t.Run(filepath.Base(tail), func(t *testing.T) {
+			b, err := os.ReadFile(tail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			apk, start, err := apkOfTail(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			z, err := newZipSections(bytes.NewReader(apk), int64(len(apk)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if z.signingBlockOffset != start {
+				t.Fatalf("APK Signing Block is at %d, expect %d", z.signingBlockOffset, start)
+			}
+			m, err := findIdValuesInApkSigningBlock(z.signingBlock, APK_CHANNEL_BLOCK_ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := walleCodec{}.decode(m[APK_CHANNEL_BLOCK_ID])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the apk before the channel was written
+			unset, err := rebuildTransform(func(signingBlock []byte) ([]byte, int, error) {
+				return rebuildSigningBlock(signingBlock, func(id uint32) bool {
+					return id != APK_CHANNEL_BLOCK_ID
+				})
+			})(&z)
+			if err != nil {
+				t.Fatal(err)
+			}
+			unsetApk, err := io.ReadAll(unset.reader())
+			if err != nil {
+				t.Fatal(err)
+			}
+			z, err = newZipSections(bytes.NewReader(unsetApk), int64(len(unsetApk)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			set, err := newTransform(info, walleCodec{}, nil)(&z)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(set.reader())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got[start:], b) {
+				t.Errorf("tail is not reproduced\n got %q\nwant %q", got[start:], b)
+			}
+		})
+	}
+}
+
+// apkOfTail returns the apk ending with tail, whose bytes before tail are zeros, and the
+// offset of tail in it. The offset is known by the offset of central directory in EOCD,
+// which immediately follows APK Signing Block at the start of tail.
+func apkOfTail(tail []byte) ([]byte, int64, error) {
+	eocd, eocdOffset, err := findEndOfCentralDirectoryRecord(bytes.NewReader(tail), int64(len(tail)))
+	if err != nil {
+		return nil, 0, err
+	}
+	if eocd == nil {
+		return nil, 0, ErrNoEOCD
+	}
+	blockSize, ok := getUint64(tail, 0)
+	if !ok || blockSize > uint64(eocdOffset) {
+		return nil, 0, corruptSigningBlock(0, "size out of range: %d", blockSize)
+	}
+	centralDirOffset, _ := getEocdCentralDirectoryOffset(eocd)
+	start := int64(centralDirOffset) - int64(blockSize) - 8
+	if start < 0 {
+		return nil, 0, corruptSigningBlock(0, "invalid offset %d", start)
+	}
+	return append(make([]byte, start), tail...), start, nil
+}
@@ -0,0 +1,86 @@
+package walle
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// LoadPemKeyPair reads the private key and the certificate chain for signing from PEM files.
+// The key may be PKCS#1, PKCS#8 or SEC 1 (EC) encoded, the first certificate in certFile
+// must be the one of the key.
+func LoadPemKeyPair(keyFile, certFile string) (crypto.Signer, []*x509.Certificate, error) {
+	key, err := LoadPemKey(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	var certs []*x509.Certificate
+	for b, rest := pem.Decode(data); b != nil; b, rest = pem.Decode(rest) {
+		if b.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(b.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot parse certificate in %s, %s", certFile, err)
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, nil, fmt.Errorf("no certificate found in %s", certFile)
+	}
+	return key, certs, nil
+}
+
+// LoadPemKey reads the private key from a PEM file, which may be PKCS#1, PKCS#8 or SEC 1 (EC)
+// encoded, e.g. to re-sign v4 signatures whose certificates are already known.
+func LoadPemKey(keyFile string) (crypto.Signer, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var key crypto.Signer
+	for b, rest := pem.Decode(data); b != nil && key == nil; b, rest = pem.Decode(rest) {
+		if !isPrivateKeyPemType(b.Type) {
+			continue
+		}
+		if _, encrypted := b.Headers["DEK-Info"]; encrypted {
+			return nil, fmt.Errorf("encrypted private key in %s is not supported", keyFile)
+		}
+		if key, err = parsePrivateKey(b.Bytes); err != nil {
+			return nil, fmt.Errorf("cannot parse private key in %s, %s", keyFile, err)
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("no private key found in %s", keyFile)
+	}
+	return key, nil
+}
+
+func isPrivateKeyPemType(t string) bool {
+	return t == "PRIVATE KEY" || t == "RSA PRIVATE KEY" || t == "EC PRIVATE KEY"
+}
+
+// Parse PKCS#1, PKCS#8 or SEC 1 (EC) encoded private key.
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if k, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return k, nil
+	}
+	if k, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if s, ok := k.(crypto.Signer); ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", k)
+	}
+	if k, err := x509.ParseECPrivateKey(der); err == nil {
+		return k, nil
+	}
+	return nil, errors.New("unknown private key format")
+}
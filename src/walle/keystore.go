@@ -0,0 +1,746 @@
+package walle
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+const _JKS_MAGIC = 0xfeedfeed
+
+var (
+	oidData                          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedData                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidKeyBag                        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidPKCS8ShroudedKeyBag           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag                       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyId                    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPBEWithSHAAnd3KeyTripleDESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPBEWithSHAAnd128BitRC2CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 5}
+	oidPBEWithSHAAnd40BitRC2CBC      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 6}
+	oidPBES2                         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2                        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHmacWithSHA1                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHmacWithSHA256                = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHmacWithSHA384                = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHmacWithSHA512                = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC                     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC                     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC                     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC                    = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidSHA1                          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256                        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384                        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512                        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	// sun.security.provider.KeyProtector
+	oidJKSKeyProtector = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+)
+
+var errWrongKeyStorePassword = errors.New("keystore was tampered with, or password was incorrect")
+
+// LoadKeyStore reads the private key of alias and its certificate chain from a JKS or
+// PKCS#12 keystore.
+// alias can be empty if the keystore holds only one private key, and keyPass defaults to
+// storePass if it is empty.
+func LoadKeyStore(file, alias, storePass, keyPass string) (crypto.Signer, []*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(keyPass) == 0 {
+		keyPass = storePass
+	}
+	var entries []keyStoreEntry
+	if len(data) >= 4 && binary.BigEndian.Uint32(data) == _JKS_MAGIC {
+		entries, err = readJKS(data, storePass)
+	} else {
+		entries, err = readPKCS12(data, storePass)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read keystore %s, %s", file, err)
+	}
+
+	var aliases []string
+	for _, e := range entries {
+		aliases = append(aliases, e.alias)
+	}
+	var entry *keyStoreEntry
+	for i := range entries {
+		if len(alias) == 0 || strings.EqualFold(alias, entries[i].alias) {
+			if entry != nil {
+				return nil, nil, fmt.Errorf("more than one private key in keystore %s, specify one of aliases: %s",
+					file, strings.Join(aliases, ","))
+			}
+			entry = &entries[i]
+		}
+	}
+	if entry == nil {
+		if len(entries) == 0 {
+			return nil, nil, fmt.Errorf("no private key in keystore %s", file)
+		}
+		return nil, nil, fmt.Errorf("no private key of alias %q in keystore %s, available aliases: %s",
+			alias, file, strings.Join(aliases, ","))
+	}
+	key, err := entry.decrypt(keyPass)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot decrypt private key %q, %s", entry.alias, err)
+	}
+	if len(entry.certs) == 0 {
+		return nil, nil, fmt.Errorf("no certificate of private key %q", entry.alias)
+	}
+	return key, entry.certs, nil
+}
+
+// ReadPassword reads a password of keystore or key from spec in the form of
+//
+//	pass:<password>  the password itself
+//	env:<name>       value of environment variable
+//	file:<path>      first line of file
+//
+// spec without prefix is treated as the password itself.
+func ReadPassword(spec string) (string, error) {
+	switch {
+	case strings.HasPrefix(spec, "env:"):
+		name := strings.TrimPrefix(spec, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(spec, "file:"):
+		data, err := os.ReadFile(strings.TrimPrefix(spec, "file:"))
+		if err != nil {
+			return "", err
+		}
+		line, _, _ := strings.Cut(string(data), "\n")
+		return strings.TrimSuffix(line, "\r"), nil
+	}
+	return strings.TrimPrefix(spec, "pass:"), nil
+}
+
+// keyStoreEntry is a private key entry in keystore.
+type keyStoreEntry struct {
+	alias string
+	// decrypt returns the private key with key password
+	decrypt func(password string) (crypto.Signer, error)
+	certs   []*x509.Certificate
+}
+
+// JKS FORMAT (big endian):
+//
+//	uint32: magic 0xfeedfeed
+//	uint32: version (1 or 2)
+//	uint32: count of entries
+//	repeated entries:
+//	    uint32: tag, 1 for private key, 2 for trusted certificate
+//	    UTF: alias
+//	    uint64: timestamp
+//	    private key:
+//	        uint32-length-prefixed: EncryptedPrivateKeyInfo
+//	        uint32: count of certificate chain
+//	        repeated certificates
+//	    trusted certificate:
+//	        certificate
+//	certificate:
+//	    UTF: type, version 2 only
+//	    uint32-length-prefixed: encoded certificate
+//	20 bytes: SHA-1 of password, "Mighty Aphrodite" and all bytes above
+func readJKS(data []byte, password string) ([]keyStoreEntry, error) {
+	if len(data) < 12+sha1.Size {
+		return nil, errors.New("JKS keystore too short")
+	}
+	content, checksum := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	h := sha1.New()
+	h.Write(jksPasswordBytes(password))
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(content)
+	if subtle.ConstantTimeCompare(h.Sum(nil), checksum) != 1 {
+		return nil, errWrongKeyStorePassword
+	}
+
+	r := &jksReader{r: bytes.NewReader(content)}
+	r.uint32() // magic
+	version := r.uint32()
+	if version != 1 && version != 2 {
+		return nil, fmt.Errorf("unsupported JKS version %d", version)
+	}
+	readCert := func() *x509.Certificate {
+		if version == 2 {
+			r.utf()
+		}
+		der := r.bytes()
+		if r.err != nil {
+			return nil
+		}
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			r.err = err
+		}
+		return c
+	}
+	var entries []keyStoreEntry
+	for count := r.uint32(); count > 0 && r.err == nil; count-- {
+		tag := r.uint32()
+		alias := r.utf()
+		r.uint64() // timestamp
+		switch tag {
+		case 1:
+			encrypted := r.bytes()
+			var certs []*x509.Certificate
+			for n := r.uint32(); n > 0 && r.err == nil; n-- {
+				certs = append(certs, readCert())
+			}
+			entries = append(entries, keyStoreEntry{
+				alias: alias,
+				decrypt: func(password string) (crypto.Signer, error) {
+					return decryptJKSKey(encrypted, password)
+				},
+				certs: certs,
+			})
+		case 2:
+			readCert()
+		default:
+			return nil, fmt.Errorf("unknown JKS entry tag %d", tag)
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("broken JKS keystore, %s", r.err)
+	}
+	return entries, nil
+}
+
+type jksReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (j *jksReader) read(n int) []byte {
+	if j.err != nil {
+		return nil
+	}
+	if n > j.r.Len() {
+		j.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := make([]byte, n)
+	_, j.err = io.ReadFull(j.r, b)
+	return b
+}
+
+func (j *jksReader) uint32() uint32 {
+	if b := j.read(4); j.err == nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (j *jksReader) uint64() uint64 {
+	if b := j.read(8); j.err == nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (j *jksReader) bytes() []byte {
+	return j.read(int(j.uint32()))
+}
+
+// modified UTF-8, prefixed with uint16 length
+func (j *jksReader) utf() string {
+	b := j.read(2)
+	if j.err != nil {
+		return ""
+	}
+	return string(j.read(int(binary.BigEndian.Uint16(b))))
+}
+
+// Decrypt the key protected by sun.security.provider.KeyProtector:
+//
+//	salt (20 bytes) || key XOR keystream || SHA-1(password || key)
+//
+// keystream is SHA-1(password || salt), SHA-1(password || previous digest) ...
+func decryptJKSKey(encrypted []byte, password string) (crypto.Signer, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(encrypted, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidJKSKeyProtector) {
+		return nil, fmt.Errorf("unsupported key protection algorithm %s", info.Algorithm.Algorithm)
+	}
+	data := info.EncryptedData
+	if len(data) < 2*sha1.Size {
+		return nil, errors.New("encrypted key too short")
+	}
+	salt, protected, check := data[:sha1.Size], data[sha1.Size:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	passwd := jksPasswordBytes(password)
+	plain := make([]byte, len(protected))
+	digest := salt
+	for i := 0; i < len(protected); i += sha1.Size {
+		h := sha1.New()
+		h.Write(passwd)
+		h.Write(digest)
+		digest = h.Sum(nil)
+		for j := 0; j < sha1.Size && i+j < len(protected); j++ {
+			plain[i+j] = protected[i+j] ^ digest[j]
+		}
+	}
+	h := sha1.New()
+	h.Write(passwd)
+	h.Write(plain)
+	if subtle.ConstantTimeCompare(h.Sum(nil), check) != 1 {
+		return nil, errors.New("key password was incorrect")
+	}
+	return parsePrivateKey(plain)
+}
+
+// password chars in big endian UTF-16, without terminator
+func jksPasswordBytes(password string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(password)) {
+		b = append(b, byte(c>>8), byte(c))
+	}
+	return b
+}
+
+// https://datatracker.ietf.org/doc/html/rfc7292
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type safeBag struct {
+	Id         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	Id    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type certBag struct {
+	Id   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type pbes2Params struct {
+	Kdf              pkix.AlgorithmIdentifier
+	EncryptionScheme pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	Prf        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+func readPKCS12(data []byte, password string) ([]keyStoreEntry, error) {
+	var pfx pfxPdu
+	if _, err := asn1.Unmarshal(data, &pfx); err != nil {
+		return nil, fmt.Errorf("neither JKS nor PKCS#12 keystore, %s", err)
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidData) {
+		return nil, errors.New("only password-protected PKCS#12 keystore is supported")
+	}
+	var authSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		return nil, err
+	}
+	if len(pfx.MacData.Mac.Algorithm.Algorithm) != 0 {
+		if err := verifyPKCS12Mac(&pfx.MacData, authSafe, password); err != nil {
+			return nil, err
+		}
+	}
+
+	var contents []contentInfo
+	if _, err := asn1.Unmarshal(authSafe, &contents); err != nil {
+		return nil, err
+	}
+	var bags []safeBag
+	for _, ci := range contents {
+		var safeContents []byte
+		switch {
+		case ci.ContentType.Equal(oidData):
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &safeContents); err != nil {
+				return nil, err
+			}
+		case ci.ContentType.Equal(oidEncryptedData):
+			var ed encryptedData
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+				return nil, err
+			}
+			var err error
+			eci := ed.EncryptedContentInfo
+			if safeContents, err = pbeDecrypt(eci.ContentEncryptionAlgorithm, password, eci.EncryptedContent); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported PKCS#12 content type %s", ci.ContentType)
+		}
+		var b []safeBag
+		if _, err := asn1.Unmarshal(safeContents, &b); err != nil {
+			return nil, err
+		}
+		bags = append(bags, b...)
+	}
+
+	type bagAttributes struct {
+		alias      string
+		localKeyId []byte
+	}
+	attributesOf := func(bag safeBag) (a bagAttributes) {
+		for _, attr := range bag.Attributes {
+			var v asn1.RawValue
+			if _, err := asn1.Unmarshal(attr.Value.Bytes, &v); err != nil {
+				continue
+			}
+			switch {
+			case attr.Id.Equal(oidFriendlyName):
+				a.alias = decodeBMPString(v.Bytes)
+			case attr.Id.Equal(oidLocalKeyId):
+				a.localKeyId = v.Bytes
+			}
+		}
+		return
+	}
+
+	type certWithAttributes struct {
+		bagAttributes
+		cert *x509.Certificate
+	}
+	var certs []certWithAttributes
+	var pool []*x509.Certificate
+	for _, bag := range bags {
+		if !bag.Id.Equal(oidCertBag) {
+			continue
+		}
+		var cb certBag
+		if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+			return nil, err
+		}
+		if !cb.Id.Equal(oidX509Certificate) {
+			continue
+		}
+		c, err := x509.ParseCertificate(cb.Data)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, certWithAttributes{attributesOf(bag), c})
+		pool = append(pool, c)
+	}
+
+	var entries []keyStoreEntry
+	for _, bag := range bags {
+		var decrypt func(string) (crypto.Signer, error)
+		value := bag.Value.Bytes
+		switch {
+		case bag.Id.Equal(oidKeyBag):
+			decrypt = func(string) (crypto.Signer, error) {
+				return parsePrivateKey(value)
+			}
+		case bag.Id.Equal(oidPKCS8ShroudedKeyBag):
+			decrypt = func(password string) (crypto.Signer, error) {
+				var info encryptedPrivateKeyInfo
+				if _, err := asn1.Unmarshal(value, &info); err != nil {
+					return nil, err
+				}
+				der, err := pbeDecrypt(info.Algorithm, password, info.EncryptedData)
+				if err != nil {
+					return nil, err
+				}
+				return parsePrivateKey(der)
+			}
+		default:
+			continue
+		}
+		attrs := attributesOf(bag)
+		entry := keyStoreEntry{alias: attrs.alias, decrypt: decrypt}
+		for _, c := range certs {
+			if len(attrs.localKeyId) != 0 && bytes.Equal(attrs.localKeyId, c.localKeyId) {
+				if len(entry.alias) == 0 {
+					entry.alias = c.alias
+				}
+				entry.certs = certificateChain(c.cert, pool)
+				break
+			}
+		}
+		if entry.certs == nil && len(certs) == 1 {
+			entry.certs = certificateChain(certs[0].cert, pool)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// certificateChain orders certificates from leaf to root as far as they can be found in pool.
+func certificateChain(leaf *x509.Certificate, pool []*x509.Certificate) []*x509.Certificate {
+	chain := []*x509.Certificate{leaf}
+	for c := leaf; !bytes.Equal(c.RawIssuer, c.RawSubject); {
+		var issuer *x509.Certificate
+		for _, p := range pool {
+			if bytes.Equal(p.RawSubject, c.RawIssuer) && c.CheckSignatureFrom(p) == nil {
+				issuer = p
+				break
+			}
+		}
+		if issuer == nil || len(chain) > len(pool) {
+			break
+		}
+		chain = append(chain, issuer)
+		c = issuer
+	}
+	return chain
+}
+
+func verifyPKCS12Mac(m *macData, content []byte, password string) error {
+	h, v, err := pkcs12Hash(m.Mac.Algorithm.Algorithm)
+	if err != nil {
+		return err
+	}
+	key := pkcs12KDF(h, v, bmpPassword(password), m.MacSalt, m.Iterations, 3, h().Size())
+	mac := hmac.New(h, key)
+	mac.Write(content)
+	if !hmac.Equal(mac.Sum(nil), m.Mac.Digest) {
+		return errWrongKeyStorePassword
+	}
+	return nil
+}
+
+// pkcs12Hash returns the hash function and its block size in bytes of oid.
+func pkcs12Hash(oid asn1.ObjectIdentifier) (func() hash.Hash, int, error) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return sha1.New, 64, nil
+	case oid.Equal(oidSHA256):
+		return sha256.New, 64, nil
+	case oid.Equal(oidSHA384):
+		return sha512.New384, 128, nil
+	case oid.Equal(oidSHA512):
+		return sha512.New, 128, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported PKCS#12 MAC algorithm %s", oid)
+}
+
+// Key derivation of PKCS#12, see RFC 7292 Appendix B.2.
+// id is 1 for key, 2 for IV and 3 for MAC key.
+func pkcs12KDF(h func() hash.Hash, v int, password, salt []byte, iterations int, id byte, size int) []byte {
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		r := make([]byte, v*((len(b)+v-1)/v))
+		for i := range r {
+			r[i] = b[i%len(b)]
+		}
+		return r
+	}
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt), fill(password)...)
+
+	var out []byte
+	for len(out) < size {
+		hh := h()
+		hh.Write(d)
+		hh.Write(i)
+		a := hh.Sum(nil)
+		for n := 1; n < iterations; n++ {
+			hh.Reset()
+			hh.Write(a)
+			a = hh.Sum(a[:0])
+		}
+		out = append(out, a...)
+
+		// I_j = (I_j + B + 1) mod 2^(v*8)
+		b := fill(a)[:v]
+		for j := 0; j < len(i); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				sum := int(i[j+k]) + int(b[k]) + carry
+				i[j+k] = byte(sum)
+				carry = sum >> 8
+			}
+		}
+	}
+	return out[:size]
+}
+
+// password in BMPString with two-byte null terminator
+func bmpPassword(password string) []byte {
+	return append(jksPasswordBytes(password), 0, 0)
+}
+
+func decodeBMPString(b []byte) string {
+	s := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		s = append(s, uint16(b[i])<<8|uint16(b[i+1]))
+	}
+	return string(utf16.Decode(s))
+}
+
+// pbeDecrypt decrypts data encrypted with password-based algorithm of PKCS#12 or PBES2.
+func pbeDecrypt(alg pkix.AlgorithmIdentifier, password string, data []byte) ([]byte, error) {
+	var block cipher.Block
+	var iv []byte
+	switch oid := alg.Algorithm; {
+	case oid.Equal(oidPBEWithSHAAnd3KeyTripleDESCBC),
+		oid.Equal(oidPBEWithSHAAnd128BitRC2CBC),
+		oid.Equal(oidPBEWithSHAAnd40BitRC2CBC):
+		var params pbeParams
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		derive := func(id byte, size int) []byte {
+			return pkcs12KDF(sha1.New, 64, bmpPassword(password), params.Salt, params.Iterations, id, size)
+		}
+		iv = derive(2, 8)
+		switch {
+		case oid.Equal(oidPBEWithSHAAnd3KeyTripleDESCBC):
+			var err error
+			if block, err = des.NewTripleDESCipher(derive(1, 24)); err != nil {
+				return nil, err
+			}
+		case oid.Equal(oidPBEWithSHAAnd128BitRC2CBC):
+			block = newRC2Cipher(derive(1, 16), 128)
+		default:
+			block = newRC2Cipher(derive(1, 5), 40)
+		}
+	case oid.Equal(oidPBES2):
+		var err error
+		if block, iv, err = pbes2Cipher(alg, password); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encryption algorithm %s", alg.Algorithm)
+	}
+
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("encrypted data is not a multiple of block size")
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+	// PKCS#7 padding
+	n := int(plain[len(plain)-1])
+	if n == 0 || n > block.BlockSize() || !bytes.Equal(plain[len(plain)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, errors.New("decryption failed, password was incorrect")
+	}
+	return plain[:len(plain)-n], nil
+}
+
+func pbes2Cipher(alg pkix.AlgorithmIdentifier, password string) (cipher.Block, []byte, error) {
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+		return nil, nil, err
+	}
+	if !params.Kdf.Algorithm.Equal(oidPBKDF2) {
+		return nil, nil, fmt.Errorf("unsupported PBES2 key derivation function %s", params.Kdf.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.Kdf.Parameters.FullBytes, &kdf); err != nil {
+		return nil, nil, err
+	}
+	var prf func() hash.Hash
+	switch oid := kdf.Prf.Algorithm; {
+	case len(oid) == 0, oid.Equal(oidHmacWithSHA1):
+		prf = sha1.New
+	case oid.Equal(oidHmacWithSHA256):
+		prf = sha256.New
+	case oid.Equal(oidHmacWithSHA384):
+		prf = sha512.New384
+	case oid.Equal(oidHmacWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, nil, fmt.Errorf("unsupported PBKDF2 PRF %s", oid)
+	}
+
+	var keyLen int
+	var newCipher func([]byte) (cipher.Block, error)
+	switch oid := params.EncryptionScheme.Algorithm; {
+	case oid.Equal(oidAES128CBC):
+		keyLen, newCipher = 16, aes.NewCipher
+	case oid.Equal(oidAES192CBC):
+		keyLen, newCipher = 24, aes.NewCipher
+	case oid.Equal(oidAES256CBC):
+		keyLen, newCipher = 32, aes.NewCipher
+	case oid.Equal(oidDESEDE3CBC):
+		keyLen, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, nil, fmt.Errorf("unsupported PBES2 encryption scheme %s", oid)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, nil, err
+	}
+	key, err := pbkdf2.Key(prf, password, kdf.Salt, kdf.Iterations, keyLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, nil, errors.New("invalid PBES2 IV")
+	}
+	return block, iv, nil
+}
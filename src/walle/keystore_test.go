@@ -0,0 +1,183 @@
+package walle
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/sha1"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// Keystores in testdata/keystore are written by keytool and openssl, see the README there.
+func TestLoadKeyStore(t *testing.T) {
+	jksKey, jksCerts, err := LoadKeyStore(keyStoreFile("cassandra.jks"), "cassandra", "cassandra", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		file  string
+		certs []string // common names of the chain
+	}{
+		{"cassandra.jks", []string{"cassandra"}},
+		{"aes.p12", []string{"cassandra", "ca"}},
+		{"aes128-sha512.p12", []string{"cassandra"}},
+		{"3des.p12", []string{"cassandra"}},
+		{"legacy.p12", []string{"cassandra"}},
+		{"rc2-128.p12", []string{"cassandra"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			// aliases are case-insensitive as keytool lowercases them
+			key, certs, err := LoadKeyStore(keyStoreFile(tt.file), "Cassandra", "cassandra", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, c := range certs {
+				names = append(names, c.Subject.CommonName)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.certs, ",") {
+				t.Errorf("chain is %v, want %v", names, tt.certs)
+			}
+			if !certs[0].Equal(jksCerts[0]) {
+				t.Error("certificate is not the one in JKS keystore")
+			}
+			if !jksKey.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public()) {
+				t.Error("private key is not the one in JKS keystore")
+			}
+		})
+	}
+
+	key, certs, err := LoadKeyStore(keyStoreFile("ec.p12"), "", "walle", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := key.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("key of ec.p12 is %T", key)
+	}
+	if !key.Public().(*ecdsa.PublicKey).Equal(certs[0].PublicKey) {
+		t.Error("key of ec.p12 is not the one of its certificate")
+	}
+}
+
+func TestLoadKeyStoreErrors(t *testing.T) {
+	dir := t.TempDir()
+	jks, err := os.ReadFile(keyStoreFile("cassandra.jks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	twoKeys := filepath.Join(dir, "two-keys.jks")
+	if err = os.WriteFile(twoKeys, testJKSWithAliases(t, jks, "cassandra", "release", "debug"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tampered := filepath.Join(dir, "tampered.jks")
+	b := append([]byte(nil), jks...)
+	b[len(b)/2] ^= 1
+	if err = os.WriteFile(tampered, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	junk := filepath.Join(dir, "junk.p12")
+	if err = os.WriteFile(junk, []byte("not a keystore"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file, alias, storePass, keyPass string
+		want                            string
+	}{
+		{keyStoreFile("cassandra.jks"), "", "wrong", "", "password was incorrect"},
+		{keyStoreFile("aes.p12"), "", "wrong", "", "password was incorrect"},
+		{keyStoreFile("legacy.p12"), "", "wrong", "", "password was incorrect"},
+		{keyStoreFile("cassandra.jks"), "", "cassandra", "wrong", "cannot decrypt private key"},
+		{keyStoreFile("aes.p12"), "", "cassandra", "wrong", "cannot decrypt private key"},
+		{keyStoreFile("legacy.p12"), "", "cassandra", "wrong", "cannot decrypt private key"},
+		{keyStoreFile("cassandra.jks"), "release", "cassandra", "", `no private key of alias "release"`},
+		{keyStoreFile("aes.p12"), "release", "cassandra", "", `no private key of alias "release"`},
+		{keyStoreFile("truststore.jks"), "", "cassandra", "", "no private key in keystore"},
+		{twoKeys, "", "cassandra", "", "specify one of aliases: release,debug"},
+		{tampered, "", "cassandra", "", "password was incorrect"},
+		{junk, "", "cassandra", "", "neither JKS nor PKCS#12"},
+	}
+	for _, tt := range tests {
+		_, _, err := LoadKeyStore(tt.file, tt.alias, tt.storePass, tt.keyPass)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("LoadKeyStore(%s, %q, %q, %q) returns %v, want %s",
+				filepath.Base(tt.file), tt.alias, tt.storePass, tt.keyPass, err, tt.want)
+		}
+	}
+
+	// either key is loaded by its alias
+	for _, alias := range []string{"release", "debug"} {
+		if _, _, err = LoadKeyStore(twoKeys, alias, "cassandra", ""); err != nil {
+			t.Errorf("cannot load key %s, %s", alias, err)
+		}
+	}
+}
+
+func TestReadPassword(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "pass")
+	if err := os.WriteFile(file, []byte("from file\r\nsecond line\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("WALLE_TEST_PASS", "from env")
+
+	tests := []struct {
+		spec, want string
+	}{
+		{"pass:secret", "secret"},
+		{"pass:", ""},
+		{"secret", "secret"},
+		{"pass:env:x", "env:x"},
+		{"env:WALLE_TEST_PASS", "from env"},
+		{"file:" + file, "from file"},
+	}
+	for _, tt := range tests {
+		if got, err := ReadPassword(tt.spec); err != nil || got != tt.want {
+			t.Errorf("ReadPassword(%q) = %q, %v, want %q", tt.spec, got, err, tt.want)
+		}
+	}
+	for _, spec := range []string{"env:WALLE_TEST_UNSET", "file:" + filepath.Join(dir, "missing")} {
+		if _, err := ReadPassword(spec); err == nil {
+			t.Errorf("ReadPassword(%q) returns no error", spec)
+		}
+	}
+}
+
+func keyStoreFile(name string) string {
+	return filepath.Join("testdata", "keystore", name)
+}
+
+// testJKSWithAliases returns a JKS keystore holding the only private key entry of jks under
+// each alias, with the integrity digest of password.
+func testJKSWithAliases(t *testing.T, jks []byte, password string, aliases ...string) []byte {
+	t.Helper()
+	if binary.BigEndian.Uint32(jks[8:]) != 1 {
+		t.Fatal("keystore holds more than one entry")
+	}
+	entry := jks[12 : len(jks)-sha1.Size]
+	tag, aliasLen := entry[:4], int(binary.BigEndian.Uint16(entry[4:]))
+	rest := entry[6+aliasLen:]
+
+	var b bytes.Buffer
+	b.Write(jks[:8]) // magic and version
+	binary.Write(&b, binary.BigEndian, uint32(len(aliases)))
+	for _, alias := range aliases {
+		b.Write(tag)
+		binary.Write(&b, binary.BigEndian, uint16(len(alias)))
+		b.WriteString(alias)
+		b.Write(rest)
+	}
+	h := sha1.New()
+	for _, c := range utf16.Encode([]rune(password)) {
+		h.Write([]byte{byte(c >> 8), byte(c)})
+	}
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(b.Bytes())
+	return h.Sum(b.Bytes())
+}
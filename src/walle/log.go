@@ -0,0 +1,27 @@
+package walle
+
+import (
+	"log/slog"
+)
+
+// nopLogger discards all logs, it is used if no logger is specified in options.
+var nopLogger = slog.New(slog.DiscardHandler)
+
+func loggerOf(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return nopLogger
+	}
+	return l
+}
+
+// LogValue logs offsets and sizes of sections, see slog.LogValuer.
+func (z zipSections) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int64("signingBlockOffset", z.signingBlockOffset),
+		slog.Int("signingBlockSize", len(z.signingBlock)),
+		slog.Int64("centralDirOffset", z.centralDirOffset),
+		slog.Int("centralDirSize", len(z.centraDir)),
+		slog.Int64("eocdOffset", z.eocdOffset),
+		slog.Int("eocdSize", len(z.eocd)),
+	)
+}
@@ -0,0 +1,287 @@
+package walle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// Manifest records the channel apks generated by one run of gen, e.g.
+//
+//	{
+//	  "files": [
+//	    {
+//	      "file": "A-meituan.apk",
+//	      "channel": "meituan",
+//	      "alias": "美团",
+//	      "extras": {"key": "value"},
+//	      "size": 1024,
+//	      "sha256": "...",
+//	      "source": "/foo/bar/A.apk",
+//	      "sourceSha256": "...",
+//	      "generatedAt": "2017-01-01T00:00:00Z"
+//	    }
+//	  ],
+//	  "summary": {...}
+//	}
+//
+// Paths of files are relative to the dir of manifest.
+type Manifest struct {
+	Files   []ManifestFile  `json:"files"`
+	Summary ManifestSummary `json:"summary"`
+}
+
+// ManifestFile is a generated channel apk in Manifest.
+type ManifestFile struct {
+	File         string            `json:"file"`
+	Channel      string            `json:"channel"`
+	Alias        string            `json:"alias,omitempty"`
+	Extras       map[string]string `json:"extras,omitempty"`
+	Size         int64             `json:"size"`
+	SHA256       string            `json:"sha256"`
+	Source       string            `json:"source"`
+	SourceSHA256 string            `json:"sourceSha256"`
+	GeneratedAt  time.Time         `json:"generatedAt"`
+}
+
+// ManifestSummary summarizes the generating in Manifest.
+type ManifestSummary struct {
+	Source       string    `json:"source"`
+	SourceSize   int64     `json:"sourceSize"`
+	SourceSHA256 string    `json:"sourceSha256"`
+	Count        int       `json:"count"`
+	TotalSize    int64     `json:"totalSize"`
+	Failed       []string  `json:"failed,omitempty"`
+	StartedAt    time.Time `json:"startedAt"`
+	FinishedAt   time.Time `json:"finishedAt"`
+}
+
+// ReadManifest reads the manifest from json file.
+func ReadManifest(file string) (*Manifest, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	m := new(Manifest)
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("cannot parse manifest %s, %s", file, err)
+	}
+	return m, nil
+}
+
+// CheckManifest re-verifies every file recorded in the manifest file: size, SHA-256,
+// channel and extras must be the same as recorded, and so must SHA-256 of its source if the
+// source still exists, which is hashed once for all files of it.
+// The returned errs holds the error of each file in m.Files, nil if the file is fine.
+func CheckManifest(file string) (m *Manifest, errs []error, err error) {
+	m, err = ReadManifest(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir := filepath.Dir(file)
+	errs = make([]error, len(m.Files))
+	sourceSums := make(map[string]string)
+	for i, f := range m.Files {
+		if errs[i] = checkManifestFile(dir, f); errs[i] == nil {
+			errs[i] = checkManifestSource(f, sourceSums)
+		}
+	}
+	return m, errs, nil
+}
+
+func checkManifestFile(dir string, f ManifestFile) error {
+	path := f.File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	sum, size, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	if size != f.Size {
+		return fmt.Errorf("size mismatched! Expect %d, but %d", f.Size, size)
+	}
+	if sum != f.SHA256 {
+		return fmt.Errorf("sha256 mismatched! Expect %s, but %s", f.SHA256, sum)
+	}
+	info, err := readChannelInfo(path, nopLogger)
+	if err != nil {
+		return fmt.Errorf("cannot read channel, %s", err)
+	}
+	if info.Channel != f.Channel {
+		return fmt.Errorf("channel mismatched! Expect %s, but %s", f.Channel, info.Channel)
+	}
+	if len(info.Extras) != len(f.Extras) || (len(f.Extras) != 0 && !reflect.DeepEqual(info.Extras, f.Extras)) {
+		return fmt.Errorf("extras mismatched! Expect %v, but %v", f.Extras, info.Extras)
+	}
+	return nil
+}
+
+// checkManifestSource checks SHA-256 of the source of f, sums caches the ones computed,
+// empty if the source no longer exists.
+func checkManifestSource(f ManifestFile, sums map[string]string) error {
+	if len(f.Source) == 0 {
+		return nil
+	}
+	sum, ok := sums[f.Source]
+	if !ok {
+		var err error
+		if sum, _, err = hashFile(f.Source); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot hash source %s, %s", f.Source, err)
+		}
+		sums[f.Source] = sum
+	}
+	if len(sum) != 0 && sum != f.SourceSHA256 {
+		return fmt.Errorf("source %s changed! Expect sha256 %s, but %s", f.Source, f.SourceSHA256, sum)
+	}
+	return nil
+}
+
+// manifestWriter collects generated files of one run of generate and writes them into file.
+type manifestWriter struct {
+	file    string
+	aliases map[string]string
+	src     *hashingReaderAt
+	size    int64
+	m       Manifest
+}
+
+// newManifestWriter returns the writer of manifest file for the apk source of size bytes.
+// SHA-256 of source is computed from src, which hashes it while it is streamed into the
+// first output, so that source is not read once more for the manifest.
+func newManifestWriter(file, source string, src *hashingReaderAt, size int64, aliases map[string]string) (*manifestWriter, error) {
+	w := &manifestWriter{file: file, aliases: aliases, src: src, size: size}
+	w.m.Summary.StartedAt = time.Now()
+	abs, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+	w.m.Summary.Source = abs
+	w.m.Summary.SourceSize = size
+	w.m.Files = []ManifestFile{}
+	return w, nil
+}
+
+// sourceSum returns the hex encoded SHA-256 of source, the bytes of it which have not been
+// streamed yet are read now.
+func (w *manifestWriter) sourceSum() (string, error) {
+	if len(w.m.Summary.SourceSHA256) == 0 {
+		sum, err := w.src.sum(w.size)
+		if err != nil {
+			return "", fmt.Errorf("cannot hash apk %s, %s", w.m.Summary.Source, err)
+		}
+		w.m.Summary.SourceSHA256 = sum
+	}
+	return w.m.Summary.SourceSHA256, nil
+}
+
+// add records output of channel info which has been generated, sum is its hex encoded SHA-256.
+func (w *manifestWriter) add(output string, info ChannelInfo, sum string) error {
+	fi, err := os.Stat(output)
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	sourceSum, err := w.sourceSum()
+	if err != nil {
+		return err
+	}
+	name := output
+	if abs, err := filepath.Abs(output); err == nil {
+		name = abs
+	}
+	if dir, err := filepath.Abs(filepath.Dir(w.file)); err == nil {
+		if rel, err := filepath.Rel(dir, name); err == nil {
+			name = rel
+		}
+	}
+	w.m.Files = append(w.m.Files, ManifestFile{
+		File:         filepath.ToSlash(name),
+		Channel:      info.Channel,
+		Alias:        w.aliases[info.Channel],
+		Extras:       info.Extras,
+		Size:         size,
+		SHA256:       sum,
+		Source:       w.m.Summary.Source,
+		SourceSHA256: sourceSum,
+		GeneratedAt:  time.Now(),
+	})
+	w.m.Summary.Count++
+	w.m.Summary.TotalSize += size
+	return nil
+}
+
+func (w *manifestWriter) fail(info ChannelInfo) {
+	w.m.Summary.Failed = append(w.m.Summary.Failed, info.Channel)
+}
+
+func (w *manifestWriter) write() error {
+	w.m.Summary.FinishedAt = time.Now()
+	if _, err := w.sourceSum(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(&w.m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileBytes(w.file, append(data, '\n'))
+}
+
+// hashFile returns the hex encoded SHA-256 and size of file.
+func hashFile(file string) (string, int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// hashingReaderAt hashes the bytes of r in order as they are read, so that a file streamed
+// from offset 0 is hashed in the same pass. Reads out of order are not hashed.
+type hashingReaderAt struct {
+	r io.ReaderAt
+	h hash.Hash
+	n int64 // bytes hashed
+}
+
+func newHashingReaderAt(r io.ReaderAt) *hashingReaderAt {
+	return &hashingReaderAt{r: r, h: sha256.New()}
+}
+
+func (r *hashingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(p, off)
+	if end := off + int64(n); off <= r.n && end > r.n {
+		r.h.Write(p[r.n-off : n])
+		r.n = end
+	}
+	return n, err
+}
+
+// sum reads the bytes up to size which have not been hashed, and returns the hex encoded
+// hash of the size bytes.
+func (r *hashingReaderAt) sum(size int64) (string, error) {
+	if r.n < size {
+		n, err := io.Copy(r.h, io.NewSectionReader(r.r, r.n, size-r.n))
+		r.n += n
+		if err != nil {
+			return "", err
+		}
+		if r.n != size {
+			return "", io.ErrUnexpectedEOF
+		}
+	}
+	return hex.EncodeToString(r.h.Sum(nil)), nil
+}
@@ -0,0 +1,202 @@
+package walle
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckManifest(t *testing.T) {
+	tests := []struct {
+		name   string
+		verify bool
+		change func(t *testing.T, source string, outputs []string)
+		errs   []string // substring of the error of each file, empty if nil
+	}{
+		{"match", false, func(*testing.T, string, []string) {}, []string{"", ""}},
+		{"match verified", true, func(*testing.T, string, []string) {}, []string{"", ""}},
+		{"tampered apk", false, func(t *testing.T, _ string, outputs []string) {
+			data, err := os.ReadFile(outputs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[0] ^= 0xff
+			if err = os.WriteFile(outputs[0], data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"sha256 mismatched", ""}},
+		{"truncated apk", false, func(t *testing.T, _ string, outputs []string) {
+			if err := os.Truncate(outputs[1], 100); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"", "size mismatched"}},
+		{"missing apk", false, func(t *testing.T, _ string, outputs []string) {
+			if err := os.Remove(outputs[0]); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"no such file", ""}},
+		{"changed source", false, func(t *testing.T, source string, _ []string) {
+			f, err := os.OpenFile(source, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if _, err = f.Write([]byte{0}); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"source", "source"}},
+		{"removed source", false, func(t *testing.T, source string, _ []string) {
+			if err := os.Remove(source); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			source := testSignedApk(t, dir)
+			data, err := os.ReadFile(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum := sha256.Sum256(data)
+			out := filepath.Join(dir, "out")
+			if err = os.Mkdir(out, 0755); err != nil {
+				t.Fatal(err)
+			}
+			file := filepath.Join(out, "manifest.json")
+			infos := []ChannelInfo{{Channel: "meituan", Extras: map[string]string{"k": "v"}}, {Channel: "huawei"}}
+			generated, err := Generate(context.Background(), source, out, infos, GenerateOptions{
+				Manifest: file, Verify: tt.verify, Aliases: map[string]string{"meituan": "美团"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := ReadManifest(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Summary.SourceSHA256 != hex.EncodeToString(sum[:]) || m.Summary.SourceSize != int64(len(data)) {
+				t.Fatalf("source recorded %s of %d bytes, want %x of %d bytes",
+					m.Summary.SourceSHA256, m.Summary.SourceSize, sum, len(data))
+			}
+			if m.Summary.Count != 2 || len(m.Files) != 2 {
+				t.Fatalf("%d files recorded, count %d, want 2", len(m.Files), m.Summary.Count)
+			}
+			outputs := make([]string, len(generated))
+			for i, g := range generated {
+				outputs[i] = g.Output
+				f := m.Files[i]
+				if f.File != filepath.Base(g.Output) || f.Channel != g.Channel || f.SourceSHA256 != m.Summary.SourceSHA256 {
+					t.Fatalf("file %d recorded %+v, want %s of %s", i, f, g.Output, g.Channel)
+				}
+			}
+			if m.Files[0].Alias != "美团" || m.Files[0].Extras["k"] != "v" {
+				t.Fatalf("alias %q and extras %v recorded", m.Files[0].Alias, m.Files[0].Extras)
+			}
+
+			tt.change(t, source, outputs)
+			_, errs, err := CheckManifest(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range tt.errs {
+				if len(want) == 0 && errs[i] != nil {
+					t.Errorf("file %d: unexpected error %v", i, errs[i])
+				} else if len(want) != 0 && (errs[i] == nil || !strings.Contains(errs[i].Error(), want)) {
+					t.Errorf("file %d: error %v, want %q", i, errs[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckManifestChannelChanged(t *testing.T) {
+	dir := t.TempDir()
+	source := testSignedApk(t, dir)
+	file := filepath.Join(dir, "manifest.json")
+	if _, err := Generate(context.Background(), source, dir, []ChannelInfo{{Channel: "meituan"}}, GenerateOptions{Manifest: file}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadManifest(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the recorded apk is replaced by the one of another channel, with size and sha256
+	// recorded accordingly
+	f := &m.Files[0]
+	var buf bytes.Buffer
+	data, err := os.ReadFile(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = WriteChannelTo(&buf, bytes.NewReader(data), int64(len(data)), ChannelInfo{Channel: "huawei"}, FormatWalle); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, f.File), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	f.Size, f.SHA256 = int64(buf.Len()), hex.EncodeToString(sum[:])
+	if data, err = json.Marshal(m); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, errs, err := CheckManifest(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs[0] == nil || !strings.Contains(errs[0].Error(), "channel mismatched") {
+		t.Fatalf("error %v, want channel mismatched", errs[0])
+	}
+
+	if _, _, err = CheckManifest(filepath.Join(dir, "missing.json")); err == nil {
+		t.Fatal("checked a missing manifest")
+	}
+}
+
+func TestHashingReaderAt(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	want := sha256.Sum256(data)
+	tests := []struct {
+		name  string
+		reads [][2]int64 // offset and length of each read
+	}{
+		{"none", nil},
+		{"in order", [][2]int64{{0, 100}, {100, 4000}, {4100, 5900}}},
+		{"prefix", [][2]int64{{0, 1000}, {1000, 1000}}},
+		{"overlapped", [][2]int64{{0, 100}, {50, 100}, {150, 10}}},
+		{"out of order", [][2]int64{{500, 100}, {0, 100}, {200, 100}, {100, 50}}},
+		{"read again", [][2]int64{{0, 10000}, {0, 10000}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newHashingReaderAt(bytes.NewReader(data))
+			for _, read := range tt.reads {
+				p := make([]byte, read[1])
+				if _, err := r.ReadAt(p, read[0]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sum, err := r.sum(int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sum != hex.EncodeToString(want[:]) {
+				t.Fatalf("sum %s, want %x", sum, want)
+			}
+		})
+	}
+	if _, err := newHashingReaderAt(bytes.NewReader(data)).sum(int64(len(data)) + 1); err == nil {
+		t.Fatal("hashed beyond the end")
+	}
+}
@@ -0,0 +1,91 @@
+package walle
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// https://github.com/mcxiaoke/packer-ng-plugin/blob/master/common/src/main/java/com/mcxiaoke/packer/common/PackerCommon.java
+const (
+	_PACKER_NG_CHANNEL_KEY = "CHANNEL"
+	_PACKER_NG_SEP_KV      = "∘" // U+2218
+	_PACKER_NG_SEP_LINE    = "∙" // U+2219
+)
+
+// packerNgCodec is the codec of FormatPackerNg, key/value pairs are written in UTF-8 as
+//
+//	key∘value∙key∘value∙
+//
+// where the channel is the value of key CHANNEL.
+type packerNgCodec struct{}
+
+func (packerNgCodec) format() ChannelFormat {
+	return FormatPackerNg
+}
+
+func (packerNgCodec) blockId() uint32 {
+	return APK_PACKER_NG_CHANNEL_BLOCK_ID
+}
+
+// encode writes the channel first and then extras in order of keys.
+func (packerNgCodec) encode(info ChannelInfo) ([]byte, error) {
+	if len(info.Channel) == 0 {
+		return nil, fmt.Errorf("no channel to write in format %s", FormatPackerNg)
+	}
+	keys := make([]string, 0, len(info.Extras))
+	for k := range info.Extras {
+		if k == _PACKER_NG_CHANNEL_KEY {
+			return nil, fmt.Errorf("key %s of extras is reserved in format %s", k, FormatPackerNg)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	write := func(k, v string) error {
+		for _, s := range []string{k, v} {
+			if len(s) == 0 || strings.Contains(s, _PACKER_NG_SEP_KV) || strings.Contains(s, _PACKER_NG_SEP_LINE) {
+				return fmt.Errorf("%q cannot be written in format %s, it is empty or contains %s or %s",
+					s, FormatPackerNg, _PACKER_NG_SEP_KV, _PACKER_NG_SEP_LINE)
+			}
+		}
+		buf.WriteString(k)
+		buf.WriteString(_PACKER_NG_SEP_KV)
+		buf.WriteString(v)
+		buf.WriteString(_PACKER_NG_SEP_LINE)
+		return nil
+	}
+	if err := write(_PACKER_NG_CHANNEL_KEY, info.Channel); err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if err := write(k, info.Extras[k]); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// decode skips malformed pairs as packer-ng-plugin does.
+func (packerNgCodec) decode(value []byte) (c ChannelInfo, err error) {
+	if !utf8.Valid(value) {
+		return c, fmt.Errorf("%w, payload of %s is not in UTF-8", ErrInvalidPayload, FormatPackerNg)
+	}
+	extras := make(map[string]string)
+	for _, line := range strings.Split(string(value), _PACKER_NG_SEP_LINE) {
+		kv := strings.Split(line, _PACKER_NG_SEP_KV)
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			continue
+		}
+		if kv[0] == _PACKER_NG_CHANNEL_KEY {
+			c.Channel = kv[1]
+		} else {
+			extras[kv[0]] = kv[1]
+		}
+	}
+	c.Extras = extras
+	return c, nil
+}
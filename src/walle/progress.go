@@ -0,0 +1,178 @@
+package walle
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GenerateEventType is the type of GenerateEvent.
+type GenerateEventType int
+
+const (
+	GenerateStarted       GenerateEventType = iota // input is parsed, Total channels to generate
+	GenerateChannelBegin                           // Channel starts to be written into Output
+	GenerateBytesWritten                           // Written of Size bytes of Output are written
+	GenerateChannelDone                            // Output of Channel is generated and verified
+	GenerateChannelFailed                          // Channel failed with Err, Output is removed
+	GenerateFinished                               // all done, or stopped by Err
+)
+
+// GenerateEvent reports the progress of Generate to GenerateOptions.Progress.
+type GenerateEvent struct {
+	Type    GenerateEventType
+	Input   string
+	Total   int // number of channels
+	Index   int // index of Channel in channels, number of generated apks on GenerateFinished
+	Channel string
+	Output  string
+	Written int64 // bytes of Output written
+	Size    int64 // size of Output, known since GenerateBytesWritten
+	Err     error
+}
+
+func (t GenerateEventType) String() string {
+	switch t {
+	case GenerateStarted:
+		return "started"
+	case GenerateChannelBegin:
+		return "channel begin"
+	case GenerateBytesWritten:
+		return "bytes written"
+	case GenerateChannelDone:
+		return "channel done"
+	case GenerateChannelFailed:
+		return "channel failed"
+	case GenerateFinished:
+		return "finished"
+	}
+	return fmt.Sprintf("GenerateEventType(%d)", int(t))
+}
+
+// redraw the progress bar at most once per this interval
+const _PROGRESS_REDRAW_INTERVAL = 100 * time.Millisecond
+
+// ProgressPrinter returns a GenerateOptions.Progress which prints progress into f:
+// a progress bar with throughput and ETA if f is a terminal, or a line per channel otherwise.
+func ProgressPrinter(f *os.File) func(GenerateEvent) {
+	p := &progressPrinter{f: f}
+	if fi, err := f.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		p.tty = true
+	}
+	return p.print
+}
+
+type progressPrinter struct {
+	mu       sync.Mutex
+	f        *os.File
+	tty      bool
+	start    time.Time
+	drawn    time.Time // when the bar is drawn last time
+	done     int       // channels done or failed
+	written  int64     // bytes written of all channels
+	current  int64     // bytes written of the current channel
+	size     int64     // size of an output, to estimate the total
+	channel  string
+	barShown bool
+}
+
+func (p *progressPrinter) print(e GenerateEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch e.Type {
+	case GenerateStarted:
+		p.start = time.Now()
+		p.println("Generating %d channel(s) for %s ...", e.Total, filepath.Base(e.Input))
+	case GenerateChannelBegin:
+		p.channel = e.Channel
+		p.current = 0
+		if !p.tty {
+			p.println("[%d/%d] generating %s", e.Index+1, e.Total, e.Output)
+		}
+	case GenerateBytesWritten:
+		p.written += e.Written - p.current
+		p.current = e.Written
+		p.size = e.Size
+	case GenerateChannelDone:
+		p.done++
+	case GenerateChannelFailed:
+		p.done++
+		p.println("[%d/%d] channel %s failed, %s", e.Index+1, e.Total, e.Channel, e.Err)
+	case GenerateFinished:
+		elapsed := time.Since(p.start)
+		if p.tty {
+			p.drawBar(e.Total)
+		}
+		p.println("Generated %d of %d channel(s) in %s, %s/s", e.Index, e.Total,
+			elapsed.Round(time.Millisecond), formatBytes(throughput(p.written, elapsed)))
+		return
+	}
+	if p.tty && (e.Type != GenerateBytesWritten || time.Since(p.drawn) >= _PROGRESS_REDRAW_INTERVAL) {
+		p.drawBar(e.Total)
+	}
+}
+
+// println prints a line, above the progress bar if it is shown.
+func (p *progressPrinter) println(format string, v ...interface{}) {
+	if p.barShown {
+		fmt.Fprint(p.f, "\r\x1b[K")
+		p.barShown = false
+	}
+	fmt.Fprintf(p.f, format+"\n", v...)
+}
+
+func (p *progressPrinter) drawBar(total int) {
+	const width = 30
+	var ratio float64
+	if estimated := p.size * int64(total); estimated > 0 {
+		ratio = float64(p.written) / float64(estimated)
+	} else if total > 0 {
+		ratio = float64(p.done) / float64(total)
+	}
+	if ratio > 1 {
+		ratio = 1
+	}
+	filled := int(ratio * width)
+	elapsed := time.Since(p.start)
+	eta := "--:--"
+	if ratio > 0 {
+		remaining := time.Duration(float64(elapsed) * (1 - ratio) / ratio)
+		eta = formatDuration(remaining)
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+	fmt.Fprintf(p.f, "\r\x1b[K%d/%d [%s] %3.0f%% %s/s ETA %s %s", p.done, total, bar, ratio*100,
+		formatBytes(throughput(p.written, elapsed)), eta, p.channel)
+	p.barShown = true
+	p.drawn = time.Now()
+}
+
+func throughput(bytes int64, elapsed time.Duration) int64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(bytes) / elapsed.Seconds())
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatDuration(d time.Duration) string {
+	s := int(d.Round(time.Second).Seconds())
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%02d:%02d", s/60, s%60)
+}
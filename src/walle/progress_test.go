@@ -0,0 +1,197 @@
+package walle
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEvent is a GenerateEvent without bytes written and error, which vary.
+type testEvent struct {
+	Type    GenerateEventType
+	Index   int
+	Channel string
+}
+
+func TestGenerateEvents(t *testing.T) {
+	dir := t.TempDir()
+	base := testSignedApk(t, dir)
+	// the second channel fails since its apk exists
+	if err := os.WriteFile(filepath.Join(dir, "base-huawei.apk"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var events []GenerateEvent
+	infos := []ChannelInfo{{Channel: "meituan"}, {Channel: "huawei"}, {Channel: "vivo"}}
+	_, err := Generate(context.Background(), base, dir, infos, GenerateOptions{Progress: func(e GenerateEvent) {
+		events = append(events, e)
+	}})
+	if err == nil {
+		t.Fatal("overwrote an exist apk without Force")
+	}
+
+	var got []testEvent
+	var written int64
+	for _, e := range events {
+		if e.Input != base || e.Total != len(infos) {
+			t.Fatalf("%s event of input %s, total %d", e.Type, e.Input, e.Total)
+		}
+		switch e.Type {
+		case GenerateBytesWritten:
+			if e.Written < written || e.Written > e.Size {
+				t.Fatalf("%d of %d bytes written after %d", e.Written, e.Size, written)
+			}
+			written = e.Written
+			continue
+		case GenerateChannelBegin:
+			written = 0
+			if e.Output != filepath.Join(dir, "base-"+e.Channel+".apk") {
+				t.Fatalf("output of %s is %s", e.Channel, e.Output)
+			}
+		case GenerateChannelDone:
+			fi, err := os.Stat(e.Output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != fi.Size() {
+				t.Fatalf("%d bytes written reported, but %s has %d bytes", written, e.Output, fi.Size())
+			}
+		case GenerateChannelFailed, GenerateFinished:
+			if e.Err == nil {
+				t.Fatalf("%s event without error", e.Type)
+			}
+		}
+		got = append(got, testEvent{e.Type, e.Index, e.Channel})
+	}
+	want := []testEvent{
+		{GenerateStarted, 0, ""},
+		{GenerateChannelBegin, 0, "meituan"},
+		{GenerateChannelDone, 0, "meituan"},
+		{GenerateChannelBegin, 1, "huawei"},
+		{GenerateChannelFailed, 1, "huawei"},
+		{GenerateFinished, 1, ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("events\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestProgressPrinterLines(t *testing.T) {
+	dir := t.TempDir()
+	base := testSignedApk(t, dir)
+	f, err := os.Create(filepath.Join(dir, "progress.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = os.WriteFile(filepath.Join(dir, "base-b.apk"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	infos := []ChannelInfo{{Channel: "a"}, {Channel: "b"}}
+	if _, err = Generate(context.Background(), base, dir, infos, GenerateOptions{Progress: ProgressPrinter(f)}); err == nil {
+		t.Fatal("overwrote an exist apk without Force")
+	}
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a file is not a terminal, so a line per channel is printed without progress bar
+	if strings.ContainsAny(string(data), "\r\x1b") {
+		t.Fatalf("progress bar is printed into a file\n%q", data)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	want := []string{
+		"^Generating 2 channel\\(s\\) for base\\.apk \\.\\.\\.$",
+		"^\\[1/2\\] generating " + regexp.QuoteMeta(filepath.Join(dir, "base-a.apk")) + "$",
+		"^\\[2/2\\] generating " + regexp.QuoteMeta(filepath.Join(dir, "base-b.apk")) + "$",
+		"^\\[2/2\\] channel b failed, .*file already exists",
+		"^Generated 1 of 2 channel\\(s\\) in [0-9.]+[µnm]?s, [0-9.]+ (B|[KMG]iB)/s$",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("%d lines printed, want %d\n%s", len(lines), len(want), data)
+	}
+	for i, line := range lines {
+		if !regexp.MustCompile(want[i]).MatchString(line) {
+			t.Errorf("line %d is %q, want %s", i+1, line, want[i])
+		}
+	}
+}
+
+func TestProgressPrinterBar(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "progress.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	p := &progressPrinter{f: f, tty: true}
+	events := []GenerateEvent{
+		{Type: GenerateStarted, Input: "A.apk", Total: 2},
+		{Type: GenerateChannelBegin, Total: 2, Index: 0, Channel: "a", Output: "A-a.apk"},
+		{Type: GenerateBytesWritten, Total: 2, Index: 0, Channel: "a", Written: 100, Size: 100},
+		{Type: GenerateChannelDone, Total: 2, Index: 0, Channel: "a"},
+		{Type: GenerateChannelBegin, Total: 2, Index: 1, Channel: "b", Output: "A-b.apk"},
+		{Type: GenerateBytesWritten, Total: 2, Index: 1, Channel: "b", Written: 100, Size: 100},
+		{Type: GenerateChannelDone, Total: 2, Index: 1, Channel: "b"},
+		{Type: GenerateFinished, Total: 2, Index: 2},
+	}
+	for _, e := range events {
+		p.print(e)
+	}
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+	// lines of channels are not printed on a terminal, the bar is redrawn in place instead
+	if strings.Contains(out, "generating A-a.apk") {
+		t.Fatalf("line of channel is printed on a terminal\n%q", out)
+	}
+	for _, s := range []string{
+		"Generating 2 channel(s) for A.apk ...\n",
+		"\r\x1b[K1/2 [===============               ]  50% ",
+		"\r\x1b[K2/2 [==============================] 100% ",
+		"\r\x1b[KGenerated 2 of 2 channel(s) in ",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("%q is not printed\n%q", s, out)
+		}
+	}
+	if !strings.HasSuffix(out, "/s\n") {
+		t.Errorf("output does not end with the summary line\n%q", out)
+	}
+}
+
+func TestFormatBytesAndDuration(t *testing.T) {
+	for n, want := range map[int64]string{
+		0:           "0 B",
+		1023:        "1023 B",
+		1024:        "1.0 KiB",
+		1536:        "1.5 KiB",
+		1024 * 1024: "1.0 MiB",
+		5 << 30:     "5.0 GiB",
+	} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %s, want %s", n, got, want)
+		}
+	}
+	for d, want := range map[time.Duration]string{
+		0:                       "00:00",
+		1499 * time.Millisecond: "00:01",
+		61 * time.Second:        "01:01",
+		time.Hour + 2*time.Minute + 3*time.Second: "1:02:03",
+	} {
+		if got := formatDuration(d); got != want {
+			t.Errorf("formatDuration(%s) = %s, want %s", d, got, want)
+		}
+	}
+	if got := throughput(1000, 0); got != 0 {
+		t.Errorf("throughput in no time is %d", got)
+	}
+	if got := throughput(1000, 2*time.Second); got != 500 {
+		t.Errorf("throughput is %d, want 500", got)
+	}
+}
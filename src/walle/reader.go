@@ -1,36 +1,46 @@
 package walle
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
 )
 
-func PrintChannel(files []string) {
-	processAllFiles(files,
+// PrintChannel prints channels of files, errors of all files are joined and returned.
+// A file without channel is printed as "channel=", which is not an error.
+func PrintChannel(files []string, opts ReadOptions) error {
+	return processAllFiles(files, loggerOf(opts.Logger),
 		func(c ChannelInfo) string {
 			return "channel=" + c.Channel
 		})
 }
 
-func PrintRaw(files []string) {
-	processAllFiles(files,
+// PrintRaw prints channel payloads of files, errors of all files are joined and returned.
+func PrintRaw(files []string, opts ReadOptions) error {
+	return processAllFiles(files, loggerOf(opts.Logger),
 		func(c ChannelInfo) string {
 			return c.String()
 		})
 }
 
 // Iterate over files with block consumer function
-func processAllFiles(files []string, process func(ChannelInfo) string) {
+func processAllFiles(files []string, logger *slog.Logger, process func(ChannelInfo) string) error {
+	var errs []error
 	for _, file := range files {
 		if !isRegularFile(file) {
 			fmt.Printf("%s is not a regular file!\n", file)
+			errs = append(errs, fmt.Errorf("%s is not a regular file", file))
 			continue
 		}
-		info, err := readChannelInfo(file)
+		// no channel is not an error, which is printed as empty
+		info, err := readChannelInfo(file, logger)
 		if err != nil {
 			fmt.Printf("Error occured on reading file %s, %s\n", file, err)
+			errs = append(errs, fmt.Errorf("%s: %w", file, err))
 			continue
 		}
 		result := process(info)
 		fmt.Printf("%s : %s\n", file, result)
 	}
+	return errors.Join(errs...)
 }
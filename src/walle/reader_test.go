@@ -0,0 +1,22 @@
+package walle
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrintChannelWithoutChannel(t *testing.T) {
+	dir := t.TempDir()
+	apk := testSignedApk(t, dir)
+	if err := PrintChannel([]string{apk}, ReadOptions{}); err != nil {
+		t.Errorf("PrintChannel of apk without channel returns %v", err)
+	}
+	if _, err := ReadChannelInfo(apk, ReadOptions{}); !errors.Is(err, ErrNoChannel) {
+		t.Errorf("ReadChannelInfo of apk without channel returns %v, want ErrNoChannel", err)
+	}
+	unsigned := filepath.Join(dir, "unsigned.apk")
+	if err := PrintChannel([]string{apk, unsigned}, ReadOptions{}); !errors.Is(err, ErrNoSigningBlock) {
+		t.Errorf("PrintChannel of unsigned apk returns %v, want ErrNoSigningBlock", err)
+	}
+}
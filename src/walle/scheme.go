@@ -0,0 +1,257 @@
+package walle
+
+import (
+	"archive/zip"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// SignatureSchemes is the signature schemes an apk is signed with, see DetectSignatureSchemes.
+type SignatureSchemes struct {
+	// V1 is true if META-INF holds a signature file *.SF along with its signature block file
+	// *.RSA, *.DSA or *.EC, which are listed in V1Files.
+	V1      bool
+	V1Files []string
+	// V1Unknown is true if the zip entries cannot be read for V1, which is reported by a warning.
+	V1Unknown bool
+	// V1ApkSigned is the X-Android-APK-Signed header of *.SF, e.g. "2, 3", which lists the
+	// newer schemes the apk is also signed with, so that stripping their blocks is detected.
+	V1ApkSigned string
+	V2          bool
+	V3          bool
+	V31         bool
+	// V4 is the sibling <apk>.idsig file of APK Signature Scheme v4, empty if absent.
+	V4          string
+	SourceStamp bool
+	// DependencyInfo is true if the encrypted dependency metadata for Google Play is present.
+	DependencyInfo bool
+	Channel        bool          // a channel is written
+	ChannelFormat  ChannelFormat // format of the channel, the one read if in more formats
+	// Warnings are issues of the schemes, mostly how a channel would break them.
+	Warnings []string
+}
+
+// the max size of the main section of *.SF to read X-Android-APK-Signed from
+const _V1_SF_MAIN_SECTION_MAX_SIZE = 64 * 1024
+
+// DetectSignatureSchemes detects the signature schemes of apk file by the IDs in its APK
+// Signing Block, the signature files in META-INF and a sibling .idsig file of v4.
+// An apk without APK Signing Block is fine, it is reported by a warning.
+func DetectSignatureSchemes(file string) (*SignatureSchemes, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	eocd, eocdOffset, err := findEndOfCentralDirectoryRecord(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	if eocd == nil {
+		return nil, ErrNoEOCD
+	}
+	centralDirOffset, _, err := eocdCentralDirectory(eocd, eocdOffset)
+	if err != nil {
+		return nil, err
+	}
+	s := new(SignatureSchemes)
+	var channelIds []uint32
+	block, _, err := findApkSigningBlock(f, centralDirOffset)
+	hasBlock := err == nil
+	switch {
+	case err == nil:
+		err = walkApkSigningBlock(block, func(id uint32, value []byte) {
+			switch id {
+			case APK_SIGNATURE_SCHEME_V2_BLOCK_ID:
+				s.V2 = true
+			case APK_SIGNATURE_SCHEME_V3_BLOCK_ID:
+				s.V3 = true
+			case APK_SIGNATURE_SCHEME_V31_BLOCK_ID:
+				s.V31 = true
+			case APK_SOURCE_STAMP_V1_BLOCK_ID, APK_SOURCE_STAMP_V2_BLOCK_ID:
+				s.SourceStamp = true
+			case APK_DEPENDENCY_INFO_BLOCK_ID:
+				s.DependencyInfo = true
+			}
+			if _, ok := codecOfBlockId(id); ok {
+				channelIds = append(channelIds, id)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, codec := range channelCodecs {
+			if isExpected(channelIds, codec.blockId()) && !s.Channel {
+				s.Channel, s.ChannelFormat = true, codec.format()
+			}
+		}
+	case errors.Is(err, ErrNoSigningBlock):
+	default:
+		return nil, err
+	}
+	// v2 and later are known from APK Signing Block, so they are still reported if the
+	// zip entries cannot be read for v1
+	v1Err := s.detectV1(f, fi.Size())
+	if fi, err := os.Stat(file + ".idsig"); err == nil && fi.Mode().IsRegular() {
+		s.V4 = file + ".idsig"
+	}
+
+	warn := func(format string, v ...interface{}) {
+		s.Warnings = append(s.Warnings, fmt.Sprintf(format, v...))
+	}
+	if v1Err != nil {
+		s.V1Unknown = true
+		warn("cannot read META-INF, v1 signature is unknown, %s", v1Err)
+	}
+	if !s.V1 && !hasBlock && v1Err == nil {
+		warn("apk is not signed")
+	} else if !hasBlock {
+		warn("no APK Signing Block, channel cannot be written, sign the apk with v2 or later")
+	}
+	for _, v := range strings.Split(s.V1ApkSigned, ",") {
+		v = strings.TrimSpace(v)
+		if (v == "2" && !s.V2) || (v == "3" && !s.V3) {
+			warn("X-Android-APK-Signed of v1 claims APK Signature Scheme v%s, but its block is absent, "+
+				"Android rejects the apk as stripped", v)
+		}
+	}
+	if s.DependencyInfo {
+		warn("dependency info is for Google Play only, some third-party stores reject apks carrying it, " +
+			"strip it by gen -strip-dependency-info")
+	}
+	if len(s.V4) != 0 {
+		warn("v4 signature %s is invalid for channel apks unless it is regenerated with its key (gen -v4)", s.V4)
+	}
+	return s, nil
+}
+
+// detectV1 scans the central directory for signature files in META-INF.
+func (s *SignatureSchemes) detectV1(r io.ReaderAt, size int64) error {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range z.File {
+		if path.Dir(f.Name) == "META-INF" {
+			files[strings.ToUpper(f.Name)] = f
+		}
+	}
+	for _, f := range z.File {
+		if path.Dir(f.Name) != "META-INF" || !strings.EqualFold(path.Ext(f.Name), ".SF") {
+			continue
+		}
+		base := strings.ToUpper(strings.TrimSuffix(f.Name, path.Ext(f.Name)))
+		for _, ext := range []string{".RSA", ".DSA", ".EC"} {
+			if sig := files[base+ext]; sig != nil {
+				s.V1 = true
+				s.V1Files = append(s.V1Files, f.Name, sig.Name)
+				if len(s.V1ApkSigned) == 0 {
+					if s.V1ApkSigned, err = readApkSignedHeader(f); err != nil {
+						return err
+					}
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// readApkSignedHeader reads X-Android-APK-Signed of the main section of signature file f.
+func readApkSignedHeader(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	r := bufio.NewReader(io.LimitReader(rc, _V1_SF_MAIN_SECTION_MAX_SIZE))
+	var header string
+	inHeader := false
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			// the main section ends with an empty line
+			return header, nil
+		}
+		switch {
+		case line[0] == ' ':
+			// continuation of the previous line
+			if inHeader {
+				header += line[1:]
+			}
+		default:
+			name, value, _ := strings.Cut(line, ":")
+			inHeader = strings.EqualFold(name, "X-Android-APK-Signed")
+			if inHeader {
+				header = strings.TrimSpace(value)
+			}
+		}
+		if err == io.EOF {
+			return header, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
+
+// PrintSignatureSchemes prints signature schemes of files, errors of all files are joined
+// and returned.
+func PrintSignatureSchemes(files []string) error {
+	yes := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	var errs []error
+	for _, file := range files {
+		s, err := DetectSignatureSchemes(file)
+		if err != nil {
+			fmt.Printf("Error occured on reading file %s, %s\n", file, err)
+			errs = append(errs, fmt.Errorf("%s: %w", file, err))
+			continue
+		}
+		v1 := yes(s.V1)
+		if s.V1Unknown {
+			v1 = "unknown"
+		} else if s.V1 {
+			v1 += " (" + strings.Join(s.V1Files, ", ")
+			if len(s.V1ApkSigned) != 0 {
+				v1 += ", X-Android-APK-Signed: " + s.V1ApkSigned
+			}
+			v1 += ")"
+		}
+		v4 := yes(len(s.V4) != 0)
+		if len(s.V4) != 0 {
+			v4 += " (" + s.V4 + ")"
+		}
+		fmt.Printf("%s :\n", file)
+		fmt.Printf("    v1: %s\n", v1)
+		fmt.Printf("    v2: %s\n", yes(s.V2))
+		fmt.Printf("    v3: %s\n", yes(s.V3))
+		fmt.Printf("    v3.1: %s\n", yes(s.V31))
+		fmt.Printf("    v4: %s\n", v4)
+		fmt.Printf("    source stamp: %s\n", yes(s.SourceStamp))
+		fmt.Printf("    dependency info: %s\n", yes(s.DependencyInfo))
+		channel := yes(s.Channel)
+		if s.Channel {
+			channel += " (" + string(s.ChannelFormat) + ")"
+		}
+		fmt.Printf("    channel: %s\n", channel)
+		for _, w := range s.Warnings {
+			fmt.Printf("    Warning: %s\n", w)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,60 @@
+package walle
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDetectSignatureSchemes(t *testing.T) {
+	dir := t.TempDir()
+	base := testSignedApk(t, dir)
+	data, err := os.ReadFile(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := newZipSections(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the central directory is still found by EOCD, but its first entry is broken, which
+	// archive/zip rejects
+	broken := filepath.Join(dir, "broken.apk")
+	data[z.centralDirOffset] ^= 0xff
+	if err = os.WriteFile(broken, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file      string
+		v1Unknown bool
+	}{
+		{base, false},
+		{broken, true},
+	}
+	for _, tt := range tests {
+		s, err := DetectSignatureSchemes(tt.file)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.file, err)
+		}
+		if !s.V2 || !s.V3 || s.V1 || s.Channel {
+			t.Errorf("%s: schemes %+v, want v2 and v3", tt.file, s)
+		}
+		if s.V1Unknown != tt.v1Unknown {
+			t.Errorf("%s: V1Unknown is %v, want %v", tt.file, s.V1Unknown, tt.v1Unknown)
+		}
+		warned := false
+		for _, w := range s.Warnings {
+			warned = warned || strings.Contains(w, "cannot read META-INF")
+		}
+		if warned != tt.v1Unknown {
+			t.Errorf("%s: warnings %q", tt.file, s.Warnings)
+		}
+	}
+
+	if _, err = DetectSignatureSchemes(filepath.Join(dir, "missing.apk")); err == nil {
+		t.Fatal("detected a missing apk")
+	}
+}
@@ -0,0 +1,118 @@
+package walle
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ChannelServer serves channel apks of base which are generated on the fly:
+// bytes before APK Signing Block are streamed from base, the new APK Signing Block,
+// central directory and EOCD are rebuilt in memory.
+//
+//	GET /download?channel=xxx
+//
+// Range requests are supported.
+type ChannelServer struct {
+	base    string
+	allowed map[string]bool
+	codec   channelCodec
+	cache   *Cache
+}
+
+// parsed sections of base are cached, and parsed again only if base is replaced
+const _SERVER_CACHE_SIZE = 64 * 1024 * 1024
+
+// NewChannelServer returns a server of base apk which serves channels in allowlist only,
+// written in format, FormatWalle if empty. Channels in allowlist must match pattern,
+// DefaultChannelPattern if nil.
+func NewChannelServer(base string, allowlist []string, pattern *regexp.Regexp, format ChannelFormat) (*ChannelServer, error) {
+	codec, err := codecOf(format)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(base)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", base)
+	}
+	if c, _ := readChannelInfo(base, nopLogger); len(c.Channel) != 0 {
+		return nil, fmt.Errorf("file %s is registered a channel block %s", filepath.Base(base), c.String())
+	}
+	if len(allowlist) == 0 {
+		return nil, fmt.Errorf("no channel allowed")
+	}
+	if err = ValidateChannels(allowlist, pattern); err != nil {
+		return nil, err
+	}
+	for _, c := range allowlist {
+		if _, err = codec.encode(ChannelInfo{Channel: c}); err != nil {
+			return nil, err
+		}
+	}
+	s := &ChannelServer{base: base, allowed: make(map[string]bool), codec: codec, cache: NewCache(_SERVER_CACHE_SIZE)}
+	for _, c := range allowlist {
+		s.allowed[c] = true
+	}
+	return s, nil
+}
+
+func (s *ChannelServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	channel := r.URL.Query().Get("channel")
+	if len(channel) == 0 {
+		http.Error(w, "no channel specified", http.StatusBadRequest)
+		return
+	}
+	if !s.allowed[channel] {
+		http.Error(w, "unknown channel", http.StatusNotFound)
+		return
+	}
+
+	apk, f, fi, err := s.cache.open(s.base, ChannelInfo{Channel: channel}, s.codec)
+	if err != nil {
+		http.Error(w, "cannot generate channel apk", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	name, ext := fileNameAndExt(s.base)
+	h := w.Header()
+	h.Set("Content-Type", "application/vnd.android.package-archive")
+	h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"-"+ChannelFileName(channel)+ext))
+	// changes along with base and channel, so that If-Range works for resuming download
+	h.Set("ETag", fmt.Sprintf(`"%x-%x-%x"`, fi.ModTime().UnixNano(), fi.Size(), crc32.ChecksumIEEE([]byte(channel))))
+	// Content-Length and Range are handled by http.ServeContent
+	http.ServeContent(w, r, "", fi.ModTime(), apk)
+}
+
+// ReadChannelList reads channels from file, one channel per line.
+// Blank lines and lines start with '#' are ignored.
+func ReadChannelList(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var channels []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		channels = append(channels, line)
+	}
+	return channels, scanner.Err()
+}
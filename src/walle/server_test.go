@@ -0,0 +1,172 @@
+package walle
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// testSignedApk returns a signed apk in dir.
+func testSignedApk(t *testing.T, dir string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apk := filepath.Join(dir, "base.apk")
+	if err = Sign(testZip(t, dir), apk, key, []*x509.Certificate{testCertificate(t, key)}, true); err != nil {
+		t.Fatal(err)
+	}
+	return apk
+}
+
+func TestChannelServer(t *testing.T) {
+	for _, format := range []ChannelFormat{FormatWalle, FormatVasDolly, FormatPackerNg} {
+		format := format
+		t.Run(string(format), func(t *testing.T) {
+			testChannelServer(t, format)
+		})
+	}
+}
+
+func testChannelServer(t *testing.T, format ChannelFormat) {
+	dir := t.TempDir()
+	base := testSignedApk(t, dir)
+	s, err := NewChannelServer(base, []string{"meituan", "huawei"}, nil, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// the apk written by gen
+	generated, err := Generate(context.Background(), base, dir, []ChannelInfo{{Channel: "meituan"}}, GenerateOptions{Format: format})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(generated[0].Output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := ChannelApkSize(f, fi.Size(), ChannelInfo{Channel: "meituan"}, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(want)) {
+		t.Fatalf("ChannelApkSize is %d, but gen writes %d bytes", size, len(want))
+	}
+	var written bytes.Buffer
+	if n, err := WriteChannelTo(&written, f, fi.Size(), ChannelInfo{Channel: "meituan"}, format); err != nil || n != size {
+		t.Fatalf("WriteChannelTo writes %d bytes, %v, want %d", n, err, size)
+	}
+	if !bytes.Equal(written.Bytes(), want) {
+		t.Error("WriteChannelTo does not write the apk written by gen")
+	}
+
+	url := ts.URL + "/download?channel=meituan"
+	resp, body := testRequest(t, http.MethodGet, url, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET status %d", resp.StatusCode)
+	}
+	if resp.ContentLength != size {
+		t.Errorf("GET Content-Length %d, want %d", resp.ContentLength, size)
+	}
+	if !bytes.Equal(body, want) {
+		t.Errorf("GET body of %d bytes is not the apk written by gen", len(body))
+	}
+
+	resp, body = testRequest(t, http.MethodHead, url, nil)
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != size || len(body) != 0 {
+		t.Errorf("HEAD status %d, Content-Length %d, %d bytes body, want 200, %d, 0",
+			resp.StatusCode, resp.ContentLength, len(body), size)
+	}
+
+	// a range across the content, APK Signing Block and central directory
+	start, end := size-4096, size-10
+	resp, body = testRequest(t, http.MethodGet, url, http.Header{
+		"Range": {"bytes=" + strconv.FormatInt(start, 10) + "-" + strconv.FormatInt(end, 10)},
+	})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Range status %d, want 206", resp.StatusCode)
+	}
+	if !bytes.Equal(body, want[start:end+1]) {
+		t.Errorf("Range body of %d bytes is not bytes [%d, %d] of the apk", len(body), start, end)
+	}
+	if cr := resp.Header.Get("Content-Range"); cr != "bytes "+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10)+"/"+strconv.FormatInt(size, 10) {
+		t.Errorf("Content-Range %s", cr)
+	}
+
+	for _, tt := range []struct {
+		method string
+		url    string
+		status int
+	}{
+		{http.MethodGet, ts.URL + "/download?channel=xiaomi", http.StatusNotFound},
+		{http.MethodGet, ts.URL + "/download", http.StatusBadRequest},
+		{http.MethodPost, url, http.StatusMethodNotAllowed},
+	} {
+		if resp, _ := testRequest(t, tt.method, tt.url, nil); resp.StatusCode != tt.status {
+			t.Errorf("%s %s status %d, want %d", tt.method, tt.url, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestNewChannelServer(t *testing.T) {
+	dir := t.TempDir()
+	base := testSignedApk(t, dir)
+	if _, err := NewChannelServer(base, nil, nil, ""); err == nil {
+		t.Error("no error for empty allowlist")
+	}
+	if _, err := NewChannelServer(base, []string{"a"}, nil, "unknown"); err == nil {
+		t.Error("no error for unknown format")
+	}
+
+	// a base with a channel in any format is rejected
+	generated, err := Generate(context.Background(), base, dir, []ChannelInfo{{Channel: "a"}},
+		GenerateOptions{Format: FormatVasDolly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewChannelServer(generated[0].Output, []string{"b"}, nil, FormatWalle); err == nil {
+		t.Error("no error for base with a channel")
+	}
+}
+
+func testRequest(t *testing.T, method, url string, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
@@ -0,0 +1,354 @@
+package walle
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+)
+
+// https://source.android.com/docs/security/features/apksigning/v2#signature-algorithm-ids
+const (
+	_SIGNATURE_RSA_PKCS1_V1_5_WITH_SHA256 = 0x0103
+	_SIGNATURE_RSA_PKCS1_V1_5_WITH_SHA512 = 0x0104
+	_SIGNATURE_ECDSA_WITH_SHA256          = 0x0201
+	_SIGNATURE_ECDSA_WITH_SHA512          = 0x0202
+
+	_CONTENT_DIGEST_CHUNK_SIZE = 1024 * 1024
+
+	// v2 signer's additional attribute which tells the verifier that the apk is signed
+	// with v3 too, so that the v3 signature cannot be stripped.
+	_V2_STRIPPING_PROTECTION_ATTR_ID = 0xbeeff00d
+	_V3_MIN_SDK_VERSION              = 28 // Android P
+	_V3_MAX_SDK_VERSION              = math.MaxInt32
+)
+
+// signatureAlgorithm describes how signed data and content digest are computed.
+type signatureAlgorithm struct {
+	id   uint32
+	hash crypto.Hash
+}
+
+func newSignatureAlgorithm(pub crypto.PublicKey) (signatureAlgorithm, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		// the same as apksigner: use SHA-512 for keys longer than 3072 bits
+		if k.N.BitLen() <= 3072 {
+			return signatureAlgorithm{_SIGNATURE_RSA_PKCS1_V1_5_WITH_SHA256, crypto.SHA256}, nil
+		}
+		return signatureAlgorithm{_SIGNATURE_RSA_PKCS1_V1_5_WITH_SHA512, crypto.SHA512}, nil
+	case *ecdsa.PublicKey:
+		if k.Curve.Params().BitSize <= 256 {
+			return signatureAlgorithm{_SIGNATURE_ECDSA_WITH_SHA256, crypto.SHA256}, nil
+		}
+		return signatureAlgorithm{_SIGNATURE_ECDSA_WITH_SHA512, crypto.SHA512}, nil
+	}
+	return signatureAlgorithm{}, fmt.Errorf("unsupported key type %T", pub)
+}
+
+// signatureAlgorithmOf returns the signature algorithm of id, e.g. the one of an existing signature.
+func signatureAlgorithmOf(id uint32) (signatureAlgorithm, error) {
+	switch id {
+	case _SIGNATURE_RSA_PKCS1_V1_5_WITH_SHA256, _SIGNATURE_ECDSA_WITH_SHA256:
+		return signatureAlgorithm{id, crypto.SHA256}, nil
+	case _SIGNATURE_RSA_PKCS1_V1_5_WITH_SHA512, _SIGNATURE_ECDSA_WITH_SHA512:
+		return signatureAlgorithm{id, crypto.SHA512}, nil
+	}
+	return signatureAlgorithm{}, fmt.Errorf("unsupported signature algorithm 0x%04x", id)
+}
+
+func (a signatureAlgorithm) newHash() hash.Hash {
+	if a.hash == crypto.SHA512 {
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+// Sign signs input with APK Signature Scheme v2, and with v3 too if v3 is true, then writes
+// the signed apk to output.
+// Existing signatures in APK Signing Block of input are replaced, other ID-value pairs
+// (e.g. the channel block) are preserved.
+func Sign(input, output string, key crypto.Signer, certs []*x509.Certificate, v3 bool) error {
+	if len(certs) == 0 {
+		return errors.New("no certificate for signing")
+	}
+	if sameFile(input, output) {
+		return fmt.Errorf("cannot sign %s in place, output must be another file", input)
+	}
+	if !bytes.Equal(publicKeyBytes(key.Public()), publicKeyBytes(certs[0].PublicKey)) {
+		return errors.New("private key does not match the public key of certificate")
+	}
+	alg, err := newSignatureAlgorithm(key.Public())
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	eocd, eocdOffset, err := findEndOfCentralDirectoryRecord(in, fi.Size())
+	if err != nil {
+		return err
+	}
+	if eocd == nil {
+		return fmt.Errorf("cannot find EOCD record in %s, maybe a broken zip file", input)
+	}
+	centralDirOffset, centralDirSize, err := eocdCentralDirectory(eocd, eocdOffset)
+	if err != nil {
+		return err
+	}
+	centralDir := make([]byte, centralDirSize)
+	if _, err = in.ReadAt(centralDir, int64(centralDirOffset)); err != nil {
+		return err
+	}
+
+	// content before APK Signing Block, or before central directory for unsigned apk
+	contentSize := int64(centralDirOffset)
+	var pairs []idValue
+	if centralDirOffset >= _APK_SIG_BLOCK_MIN_SIZE {
+		block, offset, err := findApkSigningBlock(in, centralDirOffset)
+		if err != nil && !errors.Is(err, ErrNoSigningBlock) {
+			return err
+		}
+		if err == nil {
+			contentSize = offset
+			err = walkApkSigningBlock(block, func(id uint32, value []byte) {
+				if !isSignatureBlockId(id) {
+					pairs = append(pairs, idValue{id, value})
+				}
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// the central directory offset in EOCD is replaced with the offset of APK Signing Block
+	// while computing content digest
+	digestEocd := makeEocd(eocd, uint32(contentSize))
+	digest, err := computeContentDigest(alg, io.NewSectionReader(in, 0, contentSize), centralDir, digestEocd)
+	if err != nil {
+		return err
+	}
+
+	var signatures []idValue
+	v2, err := signV2(alg, digest, key, certs, v3)
+	if err != nil {
+		return err
+	}
+	signatures = append(signatures, idValue{APK_SIGNATURE_SCHEME_V2_BLOCK_ID, v2})
+	if v3 {
+		v3Block, err := signV3(alg, digest, key, certs)
+		if err != nil {
+			return err
+		}
+		signatures = append(signatures, idValue{APK_SIGNATURE_SCHEME_V3_BLOCK_ID, v3Block})
+	}
+	signingBlock := makeApkSigningBlock(append(signatures, pairs...))
+
+	newEocd := makeEocd(eocd, uint32(contentSize+int64(len(signingBlock))))
+	return writeFile(output, func(out io.Writer) error {
+		if _, err := io.Copy(out, io.NewSectionReader(in, 0, contentSize)); err != nil {
+			return err
+		}
+		for _, s := range [][]byte{signingBlock, centralDir, newEocd} {
+			if _, err := out.Write(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func isSignatureBlockId(id uint32) bool {
+	switch id {
+	case APK_SIGNATURE_SCHEME_V2_BLOCK_ID,
+		APK_SIGNATURE_SCHEME_V3_BLOCK_ID,
+		APK_SIGNATURE_SCHEME_V31_BLOCK_ID,
+		APK_VERITY_PADDING_BLOCK_ID:
+		return true
+	}
+	return false
+}
+
+// Compute the content digest over contents before APK Signing Block, central directory and EOCD.
+//
+// Each section is split into 1MB chunks, the digest of chunk is
+//
+//	H(0xa5 || uint32(len(chunk)) || chunk)
+//
+// and the content digest is
+//
+//	H(0x5a || uint32(count of chunks) || digests of chunks)
+func computeContentDigest(alg signatureAlgorithm, content io.Reader, centralDir, eocd []byte) ([]byte, error) {
+	var digests bytes.Buffer
+	chunkCount := uint32(0)
+	prefix := make([]byte, 5)
+	buf := make([]byte, _CONTENT_DIGEST_CHUNK_SIZE)
+	h := alg.newHash()
+	for _, r := range []io.Reader{content, bytes.NewReader(centralDir), bytes.NewReader(eocd)} {
+		for {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				prefix[0] = 0xa5
+				putUint32(uint32(n), prefix, 1)
+				h.Reset()
+				h.Write(prefix)
+				h.Write(buf[:n])
+				digests.Write(h.Sum(nil))
+				chunkCount++
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	prefix[0] = 0x5a
+	putUint32(chunkCount, prefix, 1)
+	h.Reset()
+	h.Write(prefix)
+	h.Write(digests.Bytes())
+	return h.Sum(nil), nil
+}
+
+// FORMAT of v2 block:
+//
+//	length-prefixed sequence of length-prefixed signer:
+//	    length-prefixed signed data:
+//	        length-prefixed sequence of length-prefixed digests:
+//	            uint32: signature algorithm ID
+//	            length-prefixed bytes: digest
+//	        length-prefixed sequence of length-prefixed X.509 certificates
+//	        length-prefixed sequence of length-prefixed additional attributes:
+//	            uint32: ID
+//	            (length - 4) bytes: value
+//	    length-prefixed sequence of length-prefixed signatures:
+//	        uint32: signature algorithm ID
+//	        length-prefixed bytes: signature over signed data
+//	    length-prefixed bytes: public key (SubjectPublicKeyInfo, ASN.1 DER form)
+func signV2(alg signatureAlgorithm, digest []byte, key crypto.Signer, certs []*x509.Certificate, v3 bool) ([]byte, error) {
+	var attrs bytes.Buffer
+	if v3 {
+		attr := make([]byte, 8)
+		putUint32(_V2_STRIPPING_PROTECTION_ATTR_ID, attr, 0)
+		putUint32(3, attr, 4)
+		writeLengthPrefixed(&attrs, attr)
+	}
+	var signedData bytes.Buffer
+	writeLengthPrefixed(&signedData, encodeDigests(alg, digest))
+	writeLengthPrefixed(&signedData, encodeCertificates(certs))
+	writeLengthPrefixed(&signedData, attrs.Bytes())
+
+	return makeSigner(alg, key, signedData.Bytes(), nil)
+}
+
+// FORMAT of v3 block:
+//
+//	length-prefixed sequence of length-prefixed signer:
+//	    length-prefixed signed data:
+//	        length-prefixed sequence of length-prefixed digests
+//	        length-prefixed sequence of length-prefixed X.509 certificates
+//	        uint32: minSDK
+//	        uint32: maxSDK
+//	        length-prefixed sequence of length-prefixed additional attributes
+//	    uint32: minSDK
+//	    uint32: maxSDK
+//	    length-prefixed sequence of length-prefixed signatures
+//	    length-prefixed bytes: public key (SubjectPublicKeyInfo, ASN.1 DER form)
+func signV3(alg signatureAlgorithm, digest []byte, key crypto.Signer, certs []*x509.Certificate) ([]byte, error) {
+	sdk := make([]byte, 8)
+	putUint32(_V3_MIN_SDK_VERSION, sdk, 0)
+	putUint32(_V3_MAX_SDK_VERSION, sdk, 4)
+
+	var signedData bytes.Buffer
+	writeLengthPrefixed(&signedData, encodeDigests(alg, digest))
+	writeLengthPrefixed(&signedData, encodeCertificates(certs))
+	signedData.Write(sdk)
+	writeLengthPrefixed(&signedData, nil) // no additional attributes
+
+	return makeSigner(alg, key, signedData.Bytes(), sdk)
+}
+
+// makeSigner signs signedData and wraps it into a sequence with single signer,
+// extra is written between signed data and signatures.
+func makeSigner(alg signatureAlgorithm, key crypto.Signer, signedData, extra []byte) ([]byte, error) {
+	h := alg.newHash()
+	h.Write(signedData)
+	sig, err := key.Sign(rand.Reader, h.Sum(nil), alg.hash)
+	if err != nil {
+		return nil, err
+	}
+	var signature bytes.Buffer
+	writeUint32(&signature, alg.id)
+	writeLengthPrefixed(&signature, sig)
+	var signatures bytes.Buffer
+	writeLengthPrefixed(&signatures, signature.Bytes())
+
+	var signer bytes.Buffer
+	writeLengthPrefixed(&signer, signedData)
+	signer.Write(extra)
+	writeLengthPrefixed(&signer, signatures.Bytes())
+	writeLengthPrefixed(&signer, publicKeyBytes(key.Public()))
+
+	var signers bytes.Buffer
+	writeLengthPrefixed(&signers, signer.Bytes())
+	var block bytes.Buffer
+	writeLengthPrefixed(&block, signers.Bytes())
+	return block.Bytes(), nil
+}
+
+func encodeDigests(alg signatureAlgorithm, digest []byte) []byte {
+	var d bytes.Buffer
+	writeUint32(&d, alg.id)
+	writeLengthPrefixed(&d, digest)
+	var digests bytes.Buffer
+	writeLengthPrefixed(&digests, d.Bytes())
+	return digests.Bytes()
+}
+
+func encodeCertificates(certs []*x509.Certificate) []byte {
+	var b bytes.Buffer
+	for _, c := range certs {
+		writeLengthPrefixed(&b, c.Raw)
+	}
+	return b.Bytes()
+}
+
+func publicKeyBytes(pub crypto.PublicKey) []byte {
+	b, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func writeUint32(b *bytes.Buffer, v uint32) {
+	var n [4]byte
+	putUint32(v, n[:], 0)
+	b.Write(n[:])
+}
+
+func writeLengthPrefixed(b *bytes.Buffer, v []byte) {
+	writeUint32(b, uint32(len(v)))
+	b.Write(v)
+}
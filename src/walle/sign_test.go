@@ -0,0 +1,280 @@
+package walle
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []crypto.Signer{rsaKey, ecKey} {
+		for _, v3 := range []bool{false, true} {
+			key, v3 := key, v3
+			t.Run(fmtSignTest(key, v3), func(t *testing.T) {
+				testSign(t, key, v3)
+			})
+		}
+	}
+}
+
+func fmtSignTest(key crypto.Signer, v3 bool) string {
+	name := "rsa"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		name = "ecdsa-p256"
+	}
+	if v3 {
+		return name + "-v3"
+	}
+	return name + "-v2"
+}
+
+// testSign signs a zip, writes a channel into it and signs it again, the channel must be
+// kept and both signatures must be verified.
+func testSign(t *testing.T, key crypto.Signer, v3 bool) {
+	dir := t.TempDir()
+	cert := testCertificate(t, key)
+	unsigned := testZip(t, dir)
+
+	signed := filepath.Join(dir, "signed.apk")
+	if err := Sign(unsigned, signed, key, []*x509.Certificate{cert}, v3); err != nil {
+		t.Fatal(err)
+	}
+	verifyTestSignatures(t, signed, cert, v3)
+
+	// write a channel into the signed apk, which is preserved by signing again
+	info := ChannelInfo{Channel: "meituan", Extras: map[string]string{"k": "v"}}
+	channelled := filepath.Join(dir, "channelled.apk")
+	data, err := os.ReadFile(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err = WriteChannelTo(&buf, bytes.NewReader(data), int64(len(data)), info, FormatWalle); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(channelled, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	resigned := filepath.Join(dir, "resigned.apk")
+	if err = Sign(channelled, resigned, key, []*x509.Certificate{cert}, v3); err != nil {
+		t.Fatal(err)
+	}
+	pairs := verifyTestSignatures(t, resigned, cert, v3)
+	if got := pairs[APK_CHANNEL_BLOCK_ID]; !bytes.Equal(got, info.Bytes()) {
+		t.Errorf("channel block is %q after signing, want %q", got, info.Bytes())
+	}
+	c, err := ReadChannelInfo(resigned, ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Channel != info.Channel || c.Extras["k"] != "v" {
+		t.Errorf("channel is %s after signing, want %s", c.String(), info.String())
+	}
+}
+
+// testZip writes a zip with an entry larger than a chunk of content digest.
+func testZip(t *testing.T, dir string) string {
+	blob := make([]byte, _CONTENT_DIGEST_CHUNK_SIZE+_CONTENT_DIGEST_CHUNK_SIZE/2)
+	mrand.New(mrand.NewSource(1)).Read(blob)
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, e := range []struct {
+		name string
+		data []byte
+	}{{"AndroidManifest.xml", []byte("<manifest/>")}, {"assets/blob", blob}} {
+		f, err := w.CreateHeader(&zip.FileHeader{Name: e.name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "unsigned.apk")
+	if err := os.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func testCertificate(t *testing.T, key crypto.Signer) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "walle test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// verifyTestSignatures verifies the v2 signature of file, and the v3 one if v3 is true,
+// and returns the ID-value pairs of its APK Signing Block.
+func verifyTestSignatures(t *testing.T, file string, cert *x509.Certificate, v3 bool) map[uint32][]byte {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := newZipSections(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs := make(map[uint32][]byte)
+	if err = walkApkSigningBlock(z.signingBlock, func(id uint32, value []byte) {
+		pairs[id] = value
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// EOCD points at APK Signing Block while computing the digest
+	eocd := makeEocd(z.eocd, uint32(z.signingBlockOffset))
+	digest := testContentDigest(data[:z.signingBlockOffset], z.centraDir, eocd)
+
+	verifyTestSigner(t, "v2", pairs[APK_SIGNATURE_SCHEME_V2_BLOCK_ID], false, v3, cert, digest)
+	v3Block, ok := pairs[APK_SIGNATURE_SCHEME_V3_BLOCK_ID]
+	if ok != v3 {
+		t.Fatalf("has v3 signature: %v, want %v", ok, v3)
+	}
+	if v3 {
+		verifyTestSigner(t, "v3", v3Block, true, false, cert, digest)
+	}
+	return pairs
+}
+
+// testContentDigest computes the SHA-256 chunked content digest of sections.
+func testContentDigest(sections ...[]byte) []byte {
+	var digests []byte
+	count := 0
+	for _, s := range sections {
+		for len(s) > 0 {
+			n := len(s)
+			if n > 1024*1024 {
+				n = 1024 * 1024
+			}
+			h := sha256.New()
+			h.Write([]byte{0xa5, byte(n), byte(n >> 8), byte(n >> 16), byte(n >> 24)})
+			h.Write(s[:n])
+			digests = h.Sum(digests)
+			s = s[n:]
+			count++
+		}
+	}
+	h := sha256.New()
+	h.Write([]byte{0x5a, byte(count), byte(count >> 8), byte(count >> 16), byte(count >> 24)})
+	h.Write(digests)
+	return h.Sum(nil)
+}
+
+// verifyTestSigner verifies the single signer of a v2 or v3 block. The v2 signer must have
+// the stripping protection attribute if protected is true.
+func verifyTestSigner(t *testing.T, scheme string, block []byte, v3, protected bool, cert *x509.Certificate, digest []byte) {
+	t.Helper()
+	if block == nil {
+		t.Fatalf("no %s signature", scheme)
+	}
+	signers := &leReader{b: (&leReader{b: block}).bytes()}
+	signer := &leReader{b: signers.bytes()}
+	if len(signers.b) != 0 {
+		t.Fatalf("%s: more than one signer", scheme)
+	}
+	signedData := signer.bytes()
+	if v3 {
+		if min, max := signer.uint32(), signer.uint32(); min != 28 || max != 0x7fffffff {
+			t.Errorf("%s: sdk versions of signer are %d-%d", scheme, min, max)
+		}
+	}
+	signatures := &leReader{b: signer.bytes()}
+	publicKey := signer.bytes()
+	if signer.err != nil {
+		t.Fatalf("%s: cannot parse signer, %s", scheme, signer.err)
+	}
+
+	d := &leReader{b: signedData}
+	digests := &leReader{b: d.bytes()}
+	certs := &leReader{b: d.bytes()}
+	if v3 {
+		if min, max := d.uint32(), d.uint32(); min != 28 || max != 0x7fffffff {
+			t.Errorf("%s: sdk versions of signed data are %d-%d", scheme, min, max)
+		}
+	}
+	attrs := &leReader{b: d.bytes()}
+	if d.err != nil {
+		t.Fatalf("%s: cannot parse signed data, %s", scheme, d.err)
+	}
+
+	dg := &leReader{b: digests.bytes()}
+	digestAlg, gotDigest := dg.uint32(), dg.bytes()
+	if !bytes.Equal(gotDigest, digest) {
+		t.Errorf("%s: content digest is %x, want %x", scheme, gotDigest, digest)
+	}
+	if c := certs.bytes(); !bytes.Equal(c, cert.Raw) {
+		t.Errorf("%s: certificate is not the signing one", scheme)
+	}
+	var attr []byte
+	if len(attrs.b) != 0 {
+		attr = attrs.bytes()
+	}
+	if wantAttr := []byte{0x0d, 0xf0, 0xef, 0xbe, 3, 0, 0, 0}; protected != bytes.Equal(attr, wantAttr) {
+		t.Errorf("%s: additional attribute is %x, stripping protection: %v", scheme, attr, protected)
+	}
+
+	sig := &leReader{b: signatures.bytes()}
+	sigAlg, signature := sig.uint32(), sig.bytes()
+	if sigAlg != digestAlg {
+		t.Errorf("%s: signature algorithm 0x%04x, but 0x%04x of digest", scheme, sigAlg, digestAlg)
+	}
+	wantKey, _ := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if !bytes.Equal(publicKey, wantKey) {
+		t.Errorf("%s: public key is not the one of certificate", scheme)
+	}
+	hashed := sha256.Sum256(signedData)
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if sigAlg != 0x0103 {
+			t.Errorf("%s: signature algorithm is 0x%04x, want RSA PKCS#1 v1.5 with SHA-256", scheme, sigAlg)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], signature); err != nil {
+			t.Errorf("%s: %s", scheme, err)
+		}
+	case *ecdsa.PublicKey:
+		if sigAlg != 0x0201 {
+			t.Errorf("%s: signature algorithm is 0x%04x, want ECDSA with SHA-256", scheme, sigAlg)
+		}
+		if !ecdsa.VerifyASN1(pub, hashed[:], signature) {
+			t.Errorf("%s: invalid ECDSA signature", scheme)
+		}
+	}
+}
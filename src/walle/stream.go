@@ -0,0 +1,126 @@
+package walle
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// WriteChannelTo writes the apk of src with channel info in format to w, and returns the
+// number of bytes written. src is the apk of size bytes which has no channel yet in any
+// format, format is FormatWalle if empty.
+//
+// Only APK Signing Block, central directory and EOCD of src are held in memory, the bytes
+// before them are streamed from src to w.
+func WriteChannelTo(w io.Writer, src io.ReaderAt, size int64, info ChannelInfo, format ChannelFormat) (int64, error) {
+	r, err := newChannelReader(src, size, info, format)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(w, r)
+}
+
+// ChannelApkSize returns the number of bytes which WriteChannelTo would write, so that it
+// can be known before writing, e.g. for Content-Length.
+func ChannelApkSize(src io.ReaderAt, size int64, info ChannelInfo, format ChannelFormat) (int64, error) {
+	r, err := newChannelReader(src, size, info, format)
+	if err != nil {
+		return 0, err
+	}
+	return r.Size(), nil
+}
+
+// newChannelReader returns the reader of the apk of src with channel info in format.
+func newChannelReader(src io.ReaderAt, size int64, info ChannelInfo, format ChannelFormat) (*io.SectionReader, error) {
+	codec, err := codecOf(format)
+	if err != nil {
+		return nil, err
+	}
+	z, err := newZipSections(src, size)
+	if err != nil {
+		return nil, err
+	}
+	return z.channelReader(info, codec)
+}
+
+// channelReader returns the reader of the apk of z with channel info written by codec.
+// As Generate does, z must have no channel in any format.
+func (z *zipSections) channelReader(info ChannelInfo, codec channelCodec) (*io.SectionReader, error) {
+	m, err := findIdValuesInApkSigningBlock(z.signingBlock, channelBlockIds()...)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range channelCodecs {
+		if v, ok := m[c.blockId()]; ok {
+			return nil, fmt.Errorf("apk is registered a channel block of %s %q", c.format(), v)
+		}
+	}
+	newZip, err := newTransform(info, codec, nil)(z)
+	if err != nil {
+		return nil, err
+	}
+	return newZip.reader(), nil
+}
+
+// reader returns the whole zip as a reader, bytes before APK Signing Block are read from
+// source only when they are requested.
+func (z *zipSections) reader() *io.SectionReader {
+	r := newMultiReaderAt(
+		io.NewSectionReader(z.source, 0, z.signingBlockOffset),
+		bytes.NewReader(z.signingBlock),
+		bytes.NewReader(z.centraDir),
+		bytes.NewReader(z.eocd))
+	return io.NewSectionReader(r, 0, r.size)
+}
+
+type sizedReaderAt interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// multiReaderAt is the logical concatenation of parts.
+type multiReaderAt struct {
+	parts   []sizedReaderAt
+	offsets []int64 // start offset of each part
+	size    int64
+}
+
+func newMultiReaderAt(parts ...sizedReaderAt) *multiReaderAt {
+	m := &multiReaderAt{parts: parts}
+	for _, p := range parts {
+		m.offsets = append(m.offsets, m.size)
+		m.size += p.Size()
+	}
+	return m
+}
+
+func (m *multiReaderAt) ReadAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("multiReaderAt.ReadAt: negative offset")
+	}
+	for i, p := range m.parts {
+		if len(b) == 0 {
+			break
+		}
+		start, size := m.offsets[i], p.Size()
+		if off >= start+size {
+			continue
+		}
+		want := b
+		if rest := start + size - off; int64(len(want)) > rest {
+			want = want[:rest]
+		}
+		r, err := p.ReadAt(want, off-start)
+		n += r
+		off += int64(r)
+		b = b[r:]
+		if err != nil && !(err == io.EOF && r == len(want)) {
+			return n, err
+		}
+	}
+	if len(b) != 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,36 @@
+package walle
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMultiReaderAt(t *testing.T) {
+	m := newMultiReaderAt(strings.NewReader("abc"), bytes.NewReader(nil), strings.NewReader("defg"))
+	if m.size != 7 {
+		t.Fatalf("size is %d, expect 7", m.size)
+	}
+	tests := []struct {
+		off  int64
+		n    int
+		want string
+		err  error
+	}{
+		{0, 7, "abcdefg", nil},
+		{2, 3, "cde", nil},
+		{5, 4, "fg", io.EOF},
+		{7, 1, "", io.EOF},
+	}
+	for _, tt := range tests {
+		b := make([]byte, tt.n)
+		n, err := m.ReadAt(b, tt.off)
+		if string(b[:n]) != tt.want || err != tt.err {
+			t.Errorf("ReadAt(%d bytes, %d) = %q, %v, want %q, %v", tt.n, tt.off, b[:n], err, tt.want, tt.err)
+		}
+	}
+	if _, err := m.ReadAt(make([]byte, 1), -1); err == nil || !strings.Contains(err.Error(), "negative offset") {
+		t.Errorf("ReadAt at -1 returns %v, want negative offset", err)
+	}
+}
@@ -0,0 +1,78 @@
+package walle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// StripOptions controls which ID-value pairs of APK Signing Block are stripped by Strip.
+// The signature schemes v2, v3, v3.1 and the verity padding are always kept.
+type StripOptions struct {
+	// Keep are IDs kept along with the signature schemes, all the other ID-value pairs are
+	// stripped, e.g. channels of other schemes left by third-party tools.
+	Keep []uint32
+	// Drop, if not empty, are the only IDs stripped, the others are kept.
+	// It cannot be used along with Keep.
+	Drop []uint32
+}
+
+// keep reports whether the ID-value pair of id is kept.
+func (o StripOptions) keep(id uint32) bool {
+	if isSignatureBlockId(id) {
+		return true
+	}
+	if len(o.Drop) != 0 {
+		return !isExpected(o.Drop, id)
+	}
+	return isExpected(o.Keep, id)
+}
+
+// Strip writes input to output with the ID-value pairs of APK Signing Block stripped as
+// opts tells, and returns IDs of the pairs stripped.
+// APK Signing Block is rebuilt and the offset of central directory in EOCD is moved in the
+// same way as writing a channel, so the signatures are still valid for output.
+func Strip(input, output string, opts StripOptions) ([]uint32, error) {
+	if len(opts.Keep) != 0 && len(opts.Drop) != 0 {
+		return nil, errors.New("cannot keep and drop IDs at the same time")
+	}
+	for _, id := range opts.Drop {
+		if isSignatureBlockId(id) {
+			return nil, fmt.Errorf("cannot drop 0x%08x (%s), signature schemes are always kept", id, SigningBlockIdName(id))
+		}
+	}
+	if sameFile(input, output) {
+		return nil, fmt.Errorf("cannot strip %s in place, output must be another file", input)
+	}
+
+	in, err := os.Open(input)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open apk %s, %s", input, err)
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open apk %s, %s", input, err)
+	}
+	z, err := newZipSections(in, fi.Size())
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse apk %s, %w", input, err)
+	}
+	var stripped []uint32
+	err = walkApkSigningBlock(z.signingBlock, func(id uint32, value []byte) {
+		if !opts.keep(id) && !isExpected(stripped, id) {
+			stripped = append(stripped, id)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse apk %s, %w", input, err)
+	}
+	transform := rebuildTransform(func(signingBlock []byte) ([]byte, int, error) {
+		return rebuildSigningBlock(signingBlock, opts.keep)
+	})
+	if _, err = z.writeTo(context.Background(), output, transform, nil, nil); err != nil {
+		return nil, err
+	}
+	return stripped, nil
+}
@@ -0,0 +1,209 @@
+package walle
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testUnknownBlockId = 0x12345678
+
+// testStripInput writes a signed apk whose APK Signing Block also holds channels of walle
+// and VasDolly, a source stamp, dependency info, an unknown pair and the verity padding.
+func testStripInput(t *testing.T, dir string) string {
+	t.Helper()
+	data, err := os.ReadFile(testSignedApk(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := newZipSections(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newZip, err := rebuildTransform(func(signingBlock []byte) ([]byte, int, error) {
+		var pairs []idValue
+		err := walkApkSigningBlock(signingBlock, func(id uint32, value []byte) {
+			if id != APK_VERITY_PADDING_BLOCK_ID {
+				pairs = append(pairs, idValue{id, value})
+			}
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		pairs = append(pairs,
+			idValue{APK_CHANNEL_BLOCK_ID, []byte(`{"channel":"meituan"}`)},
+			idValue{APK_VASDOLLY_CHANNEL_BLOCK_ID, []byte("meituan")},
+			idValue{APK_SOURCE_STAMP_V2_BLOCK_ID, []byte("stamp")},
+			idValue{APK_DEPENDENCY_INFO_BLOCK_ID, []byte("dependencies")},
+			idValue{testUnknownBlockId, []byte("unknown")})
+		block := makeApkSigningBlock(appendVerityPadding(pairs))
+		return block, len(block) - len(signingBlock), nil
+	})(&z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apk, err := io.ReadAll(newZip.reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := filepath.Join(dir, "input.apk")
+	if err = os.WriteFile(input, apk, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return input
+}
+
+func TestStrip(t *testing.T) {
+	dir := t.TempDir()
+	input := testStripInput(t, dir)
+	inData, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := newZipSections(bytes.NewReader(inData), int64(len(inData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(in.signingBlock)%4096 != 0 {
+		t.Fatalf("APK Signing Block of input is not padded, %d bytes", len(in.signingBlock))
+	}
+	signatures := []uint32{APK_SIGNATURE_SCHEME_V2_BLOCK_ID, APK_SIGNATURE_SCHEME_V3_BLOCK_ID}
+
+	tests := []struct {
+		name     string
+		opts     StripOptions
+		stripped []uint32
+		kept     []uint32 // besides signatures
+	}{
+		{"all but signatures", StripOptions{},
+			[]uint32{APK_CHANNEL_BLOCK_ID, APK_VASDOLLY_CHANNEL_BLOCK_ID, APK_SOURCE_STAMP_V2_BLOCK_ID, APK_DEPENDENCY_INFO_BLOCK_ID, testUnknownBlockId},
+			nil},
+		{"keep", StripOptions{Keep: []uint32{APK_CHANNEL_BLOCK_ID, testUnknownBlockId}},
+			[]uint32{APK_VASDOLLY_CHANNEL_BLOCK_ID, APK_SOURCE_STAMP_V2_BLOCK_ID, APK_DEPENDENCY_INFO_BLOCK_ID},
+			[]uint32{APK_CHANNEL_BLOCK_ID, testUnknownBlockId}},
+		{"keep signatures", StripOptions{Keep: []uint32{APK_SIGNATURE_SCHEME_V2_BLOCK_ID, APK_VERITY_PADDING_BLOCK_ID}},
+			[]uint32{APK_CHANNEL_BLOCK_ID, APK_VASDOLLY_CHANNEL_BLOCK_ID, APK_SOURCE_STAMP_V2_BLOCK_ID, APK_DEPENDENCY_INFO_BLOCK_ID, testUnknownBlockId},
+			nil},
+		{"drop", StripOptions{Drop: []uint32{APK_DEPENDENCY_INFO_BLOCK_ID}},
+			[]uint32{APK_DEPENDENCY_INFO_BLOCK_ID},
+			[]uint32{APK_CHANNEL_BLOCK_ID, APK_VASDOLLY_CHANNEL_BLOCK_ID, APK_SOURCE_STAMP_V2_BLOCK_ID, testUnknownBlockId}},
+		{"drop absent", StripOptions{Drop: []uint32{APK_VASDOLLY_CHANNEL_BLOCK_ID, APK_PACKER_NG_CHANNEL_BLOCK_ID}},
+			[]uint32{APK_VASDOLLY_CHANNEL_BLOCK_ID},
+			[]uint32{APK_CHANNEL_BLOCK_ID, APK_SOURCE_STAMP_V2_BLOCK_ID, APK_DEPENDENCY_INFO_BLOCK_ID, testUnknownBlockId}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "output.apk")
+			stripped, err := Strip(input, output, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(stripped, tt.stripped) {
+				t.Errorf("stripped %x, want %x", stripped, tt.stripped)
+			}
+			data, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := newZipSections(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []uint32
+			padded := false
+			err = walkApkSigningBlock(out.signingBlock, func(id uint32, value []byte) {
+				if id == APK_VERITY_PADDING_BLOCK_ID {
+					padded = true
+				} else {
+					ids = append(ids, id)
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := append(append([]uint32{}, signatures...), tt.kept...); !reflect.DeepEqual(ids, want) {
+				t.Errorf("kept %x, want %x", ids, want)
+			}
+			// verity padding is kept, so the block is still padded to a multiple of 4096 bytes
+			if !padded || len(out.signingBlock)%4096 != 0 {
+				t.Errorf("APK Signing Block of %d bytes is not padded", len(out.signingBlock))
+			}
+
+			// EOCD is patched to point at the central directory after the new block, the rest
+			// is unchanged
+			if out.signingBlockOffset != in.signingBlockOffset {
+				t.Errorf("APK Signing Block is at %d, want %d", out.signingBlockOffset, in.signingBlockOffset)
+			}
+			if want := out.signingBlockOffset + int64(len(out.signingBlock)); out.centralDirOffset != want {
+				t.Errorf("central directory is at %d in EOCD, want %d", out.centralDirOffset, want)
+			}
+			if want := in.eocdOffset + int64(len(out.signingBlock)-len(in.signingBlock)); out.eocdOffset != want {
+				t.Errorf("EOCD is at %d, want %d", out.eocdOffset, want)
+			}
+			if !bytes.Equal(data[:out.signingBlockOffset], inData[:in.signingBlockOffset]) ||
+				!bytes.Equal(out.centraDir, in.centraDir) {
+				t.Error("content or central directory is changed")
+			}
+			if !bytes.Equal(out.eocd[:16], in.eocd[:16]) || !bytes.Equal(out.eocd[20:], in.eocd[20:]) {
+				t.Error("EOCD is changed besides the offset of central directory")
+			}
+
+			// signatures are still valid, since the digests of content, central directory
+			// and EOCD are not changed
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alg, err := newSignatureAlgorithm(key.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+			digest := func(z zipSections, data []byte) []byte {
+				eocd := makeEocd(z.eocd, uint32(z.signingBlockOffset))
+				d, err := computeContentDigest(alg, bytes.NewReader(data[:z.signingBlockOffset]), z.centraDir, eocd)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return d
+			}
+			if !bytes.Equal(digest(out, data), digest(in, inData)) {
+				t.Error("content digest is changed")
+			}
+		})
+	}
+}
+
+func TestStripErrors(t *testing.T) {
+	dir := t.TempDir()
+	input := testStripInput(t, dir)
+	output := filepath.Join(dir, "output.apk")
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		opts   StripOptions
+		err    string
+	}{
+		{"keep and drop", input, output, StripOptions{Keep: []uint32{1}, Drop: []uint32{2}}, "at the same time"},
+		{"drop v2", input, output, StripOptions{Drop: []uint32{APK_SIGNATURE_SCHEME_V2_BLOCK_ID}}, "always kept"},
+		{"drop v3.1", input, output, StripOptions{Drop: []uint32{APK_SIGNATURE_SCHEME_V31_BLOCK_ID}}, "always kept"},
+		{"drop verity padding", input, output, StripOptions{Drop: []uint32{APK_VERITY_PADDING_BLOCK_ID}}, "always kept"},
+		{"in place", input, input, StripOptions{}, "in place"},
+		{"missing", filepath.Join(dir, "missing.apk"), output, StripOptions{}, "cannot open"},
+	}
+	for _, tt := range tests {
+		if _, err := Strip(tt.input, tt.output, tt.opts); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("output is written on errors, %v", err)
+	}
+}
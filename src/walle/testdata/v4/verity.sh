@@ -0,0 +1,36 @@
+#!/bin/sh
+# Computes the fs-verity Merkle tree of APK Signature Scheme v4 with coreutils and openssl
+# only, independently of walle-go: 4096-byte blocks, the last one padded with zeros, SHA-256
+# of salt || block, levels padded with zeros to a multiple of 4096 bytes, and the root hash is
+# the digest of the top level block.
+#
+# usage: verity.sh <file> [salt in hex]
+# prints: <size> <sha256 of the tree, levels from the root to the leaves> <root hash>
+set -e
+file=$1
+salt=$2
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+printf '%s' "$salt" | xxd -r -p > "$tmp/salt"
+
+cp "$file" "$tmp/data"
+: > "$tmp/tree"
+level=0
+while :; do
+	mkdir "$tmp/$level"
+	split -a 6 -b 4096 "$tmp/data" "$tmp/$level/b."
+	: > "$tmp/level"
+	for b in "$tmp/$level"/b.*; do
+		truncate -s 4096 "$b"
+		cat "$tmp/salt" "$b" | openssl dgst -sha256 -binary >> "$tmp/level"
+	done
+	digests=$(stat -c %s "$tmp/level")
+	truncate -s $(( (digests + 4095) / 4096 * 4096 )) "$tmp/level"
+	cat "$tmp/level" "$tmp/tree" > "$tmp/t" && mv "$tmp/t" "$tmp/tree"
+	[ "$digests" -le 4096 ] && break
+	mv "$tmp/level" "$tmp/data"
+	level=$((level + 1))
+done
+root=$(head -c 4096 "$tmp/tree" | cat "$tmp/salt" - | openssl dgst -sha256 -r | cut -d' ' -f1)
+tree=$(openssl dgst -sha256 -r < "$tmp/tree" | cut -d' ' -f1)
+echo "$(stat -c %s "$file") $tree $root"
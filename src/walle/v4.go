@@ -0,0 +1,317 @@
+package walle
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// https://android.googlesource.com/platform/tools/apksig/+/refs/heads/main/src/main/java/com/android/apksig/internal/apk/v4/V4Signature.java
+const (
+	_V4_SIGNATURE_VERSION  = 2
+	_V4_HASHING_SHA256     = 1
+	_V4_LOG2_BLOCK_SIZE    = 12 // 4096 bytes
+	_V4_BLOCK_SIZE         = 1 << _V4_LOG2_BLOCK_SIZE
+	_V4_SIGNATURE_FILE_EXT = ".idsig"
+)
+
+// v4Signature is the content of an .idsig file of APK Signature Scheme v4.
+//
+// FORMAT, integers are little-endian and bytes are prefixed by int32 length:
+//
+//	int32: version
+//	bytes: hashing info
+//	    int32: hash algorithm
+//	    int8:  log2 of block size
+//	    bytes: salt
+//	    bytes: root hash of Merkle tree
+//	bytes: signing infos
+//	    signing info:
+//	        bytes: apk digest, the content digest of v3 or v2 signer
+//	        bytes: certificate
+//	        bytes: additional data
+//	        bytes: public key
+//	        int32: signature algorithm ID
+//	        bytes: signature over signed data, see signedData
+//	    repeated signing info blocks of v3.1 signers:
+//	        int32: block ID
+//	        bytes: block
+//	bytes: Merkle tree, optional
+type v4Signature struct {
+	hashAlgorithm  uint32
+	log2BlockSize  byte
+	salt           []byte
+	rootHash       []byte
+	apkDigest      []byte
+	certificate    []byte
+	additionalData []byte
+	publicKey      []byte
+	algorithmId    uint32
+	signature      []byte
+	// signing info blocks of v3.1 signers, which cannot be re-signed with a single key
+	signingInfoBlocks []byte
+}
+
+// v4SignatureFile returns the .idsig file of v4 signature of apk.
+func v4SignatureFile(apk string) string {
+	return apk + _V4_SIGNATURE_FILE_EXT
+}
+
+// leReader reads little-endian integers and length-prefixed bytes, with bounds checked.
+type leReader struct {
+	b   []byte
+	err error
+}
+
+func (r *leReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *leReader) uint32() uint32 {
+	v, _ := getUint32(r.next(4), 0) // 0 if r.err is set
+	return v
+}
+
+func (r *leReader) byte() byte {
+	if v := r.next(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *leReader) bytes() []byte {
+	n := r.uint32()
+	if r.err != nil || n > uint32(len(r.b)) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	return r.next(int(n))
+}
+
+func readV4Signature(file string) (*v4Signature, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	s, err := parseV4Signature(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse v4 signature %s, %s", file, err)
+	}
+	return s, nil
+}
+
+func parseV4Signature(data []byte) (*v4Signature, error) {
+	r := &leReader{b: data}
+	if v := r.uint32(); r.err == nil && v != _V4_SIGNATURE_VERSION {
+		return nil, fmt.Errorf("unsupported version %d", v)
+	}
+	hashing := &leReader{b: r.bytes()}
+	signing := &leReader{b: r.bytes()}
+	if r.err != nil {
+		return nil, r.err
+	}
+	s := new(v4Signature)
+	s.hashAlgorithm = hashing.uint32()
+	s.log2BlockSize = hashing.byte()
+	s.salt = hashing.bytes()
+	s.rootHash = hashing.bytes()
+	if hashing.err != nil {
+		return nil, fmt.Errorf("broken hashing info, %s", hashing.err)
+	}
+	if s.hashAlgorithm != _V4_HASHING_SHA256 || s.log2BlockSize != _V4_LOG2_BLOCK_SIZE {
+		return nil, fmt.Errorf("unsupported hash algorithm %d with block size 2^%d", s.hashAlgorithm, s.log2BlockSize)
+	}
+	s.apkDigest = signing.bytes()
+	s.certificate = signing.bytes()
+	s.additionalData = signing.bytes()
+	s.publicKey = signing.bytes()
+	s.algorithmId = signing.uint32()
+	s.signature = signing.bytes()
+	if signing.err != nil {
+		return nil, fmt.Errorf("broken signing info, %s", signing.err)
+	}
+	s.signingInfoBlocks = signing.b
+	return s, nil
+}
+
+// signedData returns the data signed by v4 signature of an apk with fileSize bytes.
+//
+// FORMAT:
+//
+//	int32: size of signed data
+//	int64: file size
+//	int32: hash algorithm
+//	int8:  log2 of block size
+//	bytes: salt
+//	bytes: root hash
+//	bytes: apk digest
+//	bytes: certificate
+//	bytes: additional data
+func (s *v4Signature) signedData(fileSize int64) []byte {
+	var b bytes.Buffer
+	size := 4 + 8 + 4 + 1
+	for _, v := range [][]byte{s.salt, s.rootHash, s.apkDigest, s.certificate, s.additionalData} {
+		size += 4 + len(v)
+	}
+	writeUint32(&b, uint32(size))
+	writeUint32(&b, uint32(fileSize))
+	writeUint32(&b, uint32(uint64(fileSize)>>32))
+	writeUint32(&b, s.hashAlgorithm)
+	b.WriteByte(s.log2BlockSize)
+	for _, v := range [][]byte{s.salt, s.rootHash, s.apkDigest, s.certificate, s.additionalData} {
+		writeLengthPrefixed(&b, v)
+	}
+	return b.Bytes()
+}
+
+// bytes returns the .idsig file content with Merkle tree.
+func (s *v4Signature) bytes(tree []byte) []byte {
+	var hashing bytes.Buffer
+	writeUint32(&hashing, s.hashAlgorithm)
+	hashing.WriteByte(s.log2BlockSize)
+	writeLengthPrefixed(&hashing, s.salt)
+	writeLengthPrefixed(&hashing, s.rootHash)
+
+	var signing bytes.Buffer
+	for _, v := range [][]byte{s.apkDigest, s.certificate, s.additionalData, s.publicKey} {
+		writeLengthPrefixed(&signing, v)
+	}
+	writeUint32(&signing, s.algorithmId)
+	writeLengthPrefixed(&signing, s.signature)
+	signing.Write(s.signingInfoBlocks)
+
+	var b bytes.Buffer
+	writeUint32(&b, _V4_SIGNATURE_VERSION)
+	writeLengthPrefixed(&b, hashing.Bytes())
+	writeLengthPrefixed(&b, signing.Bytes())
+	writeLengthPrefixed(&b, tree)
+	return b.Bytes()
+}
+
+// checkKey checks whether v4 signature s can be re-signed by key.
+func (s *v4Signature) checkKey(key crypto.Signer) error {
+	if len(s.signingInfoBlocks) != 0 {
+		return errors.New("it is signed by more than one signer (v3.1), re-sign channel apks with apksigner")
+	}
+	if key == nil {
+		return errors.New("it must be re-signed for channel apks, specify the key of it")
+	}
+	if !bytes.Equal(publicKeyBytes(key.Public()), s.publicKey) {
+		return errors.New("the key is not the one of it")
+	}
+	if _, err := signatureAlgorithmOf(s.algorithmId); err != nil {
+		return err
+	}
+	return nil
+}
+
+// regenerate computes the Merkle tree of apk, which has the same signing info as s except
+// for the signature, re-signs it by key and writes it into the .idsig file of apk.
+// The apk digest of s is still valid for apk, since a channel changes neither the content
+// digest of v2 nor the one of v3.
+func (s *v4Signature) regenerate(apk string, key crypto.Signer) error {
+	f, err := os.Open(apk)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	tree, root, err := computeVerityTree(f, fi.Size(), s.salt)
+	if err != nil {
+		return err
+	}
+	alg, err := signatureAlgorithmOf(s.algorithmId)
+	if err != nil {
+		return err
+	}
+	n := *s
+	n.rootHash = root
+	h := alg.newHash()
+	h.Write(n.signedData(fi.Size()))
+	if n.signature, err = key.Sign(rand.Reader, h.Sum(nil), alg.hash); err != nil {
+		return err
+	}
+	return writeFileBytes(v4SignatureFile(apk), n.bytes(tree))
+}
+
+// computeVerityTree computes the fs-verity Merkle tree of r with size bytes, in 4096-byte
+// blocks and SHA-256 salted by salt, as apksig does for v4: levels are stored from the root
+// to the leaves, each level is padded with zeros to a multiple of 4096 bytes, and the root
+// hash is the digest of the first block of the tree.
+func computeVerityTree(r io.ReaderAt, size int64, salt []byte) (tree, root []byte, err error) {
+	if size <= 0 {
+		return nil, nil, errors.New("cannot compute Merkle tree of an empty file")
+	}
+	// sizes of levels from the leaves to the root
+	var levels []int64
+	for n := size; ; {
+		blocks := (n + _V4_BLOCK_SIZE - 1) / _V4_BLOCK_SIZE
+		digests := blocks * sha256.Size
+		levels = append(levels, (digests+_V4_BLOCK_SIZE-1)/_V4_BLOCK_SIZE*_V4_BLOCK_SIZE)
+		if digests <= _V4_BLOCK_SIZE {
+			break
+		}
+		n = digests
+	}
+	var total int64
+	for _, l := range levels {
+		total += l
+	}
+	tree = make([]byte, total)
+	// the leaves are at the end of tree, and digest data of r
+	end := total
+	var src io.ReaderAt = r
+	srcSize := size
+	for _, l := range levels {
+		level := tree[end-l : end]
+		if err = hashBlocks(src, srcSize, salt, level); err != nil {
+			return nil, nil, err
+		}
+		src, srcSize = bytes.NewReader(level), l
+		end -= l
+	}
+	root = saltedDigest(salt, tree[:_V4_BLOCK_SIZE])
+	return tree, root, nil
+}
+
+// hashBlocks writes digests of every 4096-byte block of r into level, the last block is
+// padded with zeros.
+func hashBlocks(r io.ReaderAt, size int64, salt, level []byte) error {
+	block := make([]byte, _V4_BLOCK_SIZE)
+	for i, offset := 0, int64(0); offset < size; i, offset = i+1, offset+_V4_BLOCK_SIZE {
+		n, err := r.ReadAt(block, offset)
+		if n < len(block) && offset+int64(n) < size {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		clear(block[n:])
+		copy(level[i*sha256.Size:], saltedDigest(salt, block))
+	}
+	return nil
+}
+
+func saltedDigest(salt, data []byte) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(data)
+	return h.Sum(nil)
+}
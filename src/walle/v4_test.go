@@ -0,0 +1,223 @@
+package walle
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testVerityData returns size bytes of "walle\n" repeated, the same as `yes walle | head -c size`.
+func testVerityData(size int) []byte {
+	return bytes.Repeat([]byte("walle\n"), size/6+1)[:size]
+}
+
+// Expected values are printed by testdata/v4/verity.sh, which computes the tree with
+// coreutils and openssl only, e.g. `yes walle | head -c 4097 > f && verity.sh f`.
+func TestComputeVerityTree(t *testing.T) {
+	tests := []struct {
+		size int
+		salt string
+		tree string // SHA-256 of the whole tree
+		root string
+	}{
+		{1, "", "86b959ca499b1a36610d6be6f880dba590430f0feb6e54910b3a28c563cce6fb", "86b959ca499b1a36610d6be6f880dba590430f0feb6e54910b3a28c563cce6fb"},
+		{4095, "", "4aa4e49ee7e6e1a3e7833eb965dc560d16e68097f431967629c80df9eca9d47c", "4aa4e49ee7e6e1a3e7833eb965dc560d16e68097f431967629c80df9eca9d47c"},
+		{4096, "", "d8a26f3dfd08533670db234e7e062546e540fa75515cb32a07d06f014dd5b554", "d8a26f3dfd08533670db234e7e062546e540fa75515cb32a07d06f014dd5b554"},
+		{4097, "", "756517a4b0ae898016be993eb1f83569a9b0454582c7c3613433b58e2e2720e5", "756517a4b0ae898016be993eb1f83569a9b0454582c7c3613433b58e2e2720e5"},
+		// 128 leaf digests fill exactly one block
+		{524288, "", "e3a48b643ea0669f1995203c168c1e3639bda30c9e4394875bfc3232f1424689", "e3a48b643ea0669f1995203c168c1e3639bda30c9e4394875bfc3232f1424689"},
+		// one more byte needs another level
+		{524289, "", "6458fb56e50af4d4b751088edf5556d72d93f16a8c3db9c8cea481810beb1b37", "5c3f514f4f6062158dce1df4aabab9f9a3e76365fdc3610e5cf5ad85a6a7b0a9"},
+		{1000000, "", "d441ece129efa63d5d75f462653c38eec4514ee72ec797cfad5d1db3288a8eba", "43454170d3c93c684845294ceb81c048f4abcf22ee73aa7d1c62fca9b1d6d203"},
+		{10000, "0123456789abcdef", "7d83b852fcb4218a9a4346844fdff58015ac5aeb767396bde89a925ac6d4bffc", "2de55f1bda854ef3c48e8ab3040b35f69f7076ab6013be2fae206fb07bdb36c1"},
+		// three levels
+		{67108865, "", "2b683171a25ee06fb5455b51915cf7e937f7fc514690be55481983c2752bbfa0", "d7c1128de1125676620445d2ec6b2d5bacb8f6c72a18d994d7eaa18f3a0c8723"},
+	}
+	for _, tt := range tests {
+		if tt.size > 1<<20 && testing.Short() {
+			continue
+		}
+		salt, err := hex.DecodeString(tt.salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, root, err := computeVerityTree(bytes.NewReader(testVerityData(tt.size)), int64(tt.size), salt)
+		if err != nil {
+			t.Fatalf("%d bytes: %s", tt.size, err)
+		}
+		if len(tree)%_V4_BLOCK_SIZE != 0 {
+			t.Errorf("%d bytes: tree of %d bytes is not padded", tt.size, len(tree))
+		}
+		if sum := sha256.Sum256(tree); hex.EncodeToString(sum[:]) != tt.tree {
+			t.Errorf("%d bytes: tree sha256 %x, want %s", tt.size, sum, tt.tree)
+		}
+		if hex.EncodeToString(root) != tt.root {
+			t.Errorf("%d bytes: root hash %x, want %s", tt.size, root, tt.root)
+		}
+	}
+
+	if _, _, err := computeVerityTree(bytes.NewReader(nil), 0, nil); err == nil {
+		t.Error("computed the tree of an empty file")
+	}
+	// r is shorter than size
+	if _, _, err := computeVerityTree(bytes.NewReader(testVerityData(5000)), 10000, nil); err == nil {
+		t.Error("computed the tree of a truncated file")
+	}
+}
+
+// testV4Signature writes the .idsig of apk signed by key, with the apk digest and the
+// certificate given, as apksigner does.
+func testV4Signature(t *testing.T, apk string, key *ecdsa.PrivateKey, cert *x509.Certificate, apkDigest []byte) *v4Signature {
+	t.Helper()
+	s := &v4Signature{
+		hashAlgorithm:  _V4_HASHING_SHA256,
+		log2BlockSize:  _V4_LOG2_BLOCK_SIZE,
+		apkDigest:      apkDigest,
+		certificate:    cert.Raw,
+		additionalData: []byte{},
+		publicKey:      publicKeyBytes(key.Public()),
+		algorithmId:    _SIGNATURE_ECDSA_WITH_SHA256,
+	}
+	if err := s.regenerate(apk, key); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestGenerateV4(t *testing.T) {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := testCertificate(t, key)
+	base := filepath.Join(dir, "base.apk")
+	if err = Sign(testZip(t, dir), base, key, []*x509.Certificate{cert}, true); err != nil {
+		t.Fatal(err)
+	}
+	apkDigest := bytes.Repeat([]byte{0xab}, 32)
+	testV4Signature(t, base, key, cert, apkDigest)
+	origin, err := os.ReadFile(v4SignatureFile(base))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "out")
+	if err = os.Mkdir(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	generated, err := Generate(context.Background(), base, out, []ChannelInfo{{Channel: "meituan"}}, GenerateOptions{V4: true, V4Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := generated[0].Output
+	data, err := os.ReadFile(v4SignatureFile(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(data, origin) {
+		t.Fatal(".idsig is not regenerated")
+	}
+	s, err := parseV4Signature(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apk, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, root, err := computeVerityTree(bytes.NewReader(apk), int64(len(apk)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(s.rootHash, root) {
+		t.Errorf("root hash %x, want %x", s.rootHash, root)
+	}
+	if !bytes.Equal(data, s.bytes(tree)) {
+		t.Error("Merkle tree in .idsig is not the one of output")
+	}
+	// signing info is kept but the signature, which is over the new root hash
+	if !bytes.Equal(s.apkDigest, apkDigest) || !bytes.Equal(s.certificate, cert.Raw) ||
+		!bytes.Equal(s.publicKey, publicKeyBytes(key.Public())) || s.algorithmId != _SIGNATURE_ECDSA_WITH_SHA256 {
+		t.Errorf("signing info is changed, %+v", s)
+	}
+	h := sha256.Sum256(s.signedData(int64(len(apk))))
+	if !ecdsa.VerifyASN1(&key.PublicKey, h[:], s.signature) {
+		t.Error("signature is not verified by the key")
+	}
+
+	// without V4, the .idsig of input is not copied
+	generated, err = Generate(context.Background(), base, out, []ChannelInfo{{Channel: "huawei"}}, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(v4SignatureFile(generated[0].Output)); !os.IsNotExist(err) {
+		t.Errorf(".idsig is written without V4, %v", err)
+	}
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		opts GenerateOptions
+		err  string
+	}{
+		{"no key", GenerateOptions{V4: true, Force: true}, "specify the key"},
+		{"another key", GenerateOptions{V4: true, V4Key: other, Force: true}, "not the one"},
+	} {
+		if _, err = Generate(context.Background(), base, out, []ChannelInfo{{Channel: "vivo"}}, tt.opts); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+	if err = os.Remove(v4SignatureFile(base)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Generate(context.Background(), base, out, []ChannelInfo{{Channel: "vivo"}}, GenerateOptions{V4: true, V4Key: key}); err == nil {
+		t.Error("generated with V4 but no .idsig of input")
+	}
+}
+
+func TestParseV4Signature(t *testing.T) {
+	s := &v4Signature{
+		hashAlgorithm:     _V4_HASHING_SHA256,
+		log2BlockSize:     _V4_LOG2_BLOCK_SIZE,
+		salt:              []byte("salt"),
+		rootHash:          bytes.Repeat([]byte{1}, 32),
+		apkDigest:         bytes.Repeat([]byte{2}, 32),
+		certificate:       []byte("certificate"),
+		additionalData:    []byte{},
+		publicKey:         []byte("public key"),
+		algorithmId:       _SIGNATURE_ECDSA_WITH_SHA256,
+		signature:         []byte("signature"),
+		signingInfoBlocks: []byte{},
+	}
+	data := s.bytes([]byte("tree"))
+	got, err := parseV4Signature(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.bytes([]byte("tree")), data) {
+		t.Fatal(".idsig is not reproduced")
+	}
+	for n := 0; n < len(data)-4-len("tree"); n++ {
+		if _, err = parseV4Signature(data[:n]); err == nil {
+			t.Fatalf("parsed %d of %d bytes", n, len(data))
+		}
+	}
+	unsupported := *s
+	unsupported.log2BlockSize = 10
+	if _, err = parseV4Signature(unsupported.bytes(nil)); err == nil {
+		t.Fatal("parsed an unsupported block size")
+	}
+}
@@ -0,0 +1,36 @@
+package walle
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// vasDollyCodec is the codec of FormatVasDolly, the channel is written in UTF-8 as it is.
+// https://github.com/Tencent/VasDolly/blob/master/writer/src/main/java/com/leon/channel/writer/ChannelWriter.java
+type vasDollyCodec struct{}
+
+func (vasDollyCodec) format() ChannelFormat {
+	return FormatVasDolly
+}
+
+func (vasDollyCodec) blockId() uint32 {
+	return APK_VASDOLLY_CHANNEL_BLOCK_ID
+}
+
+func (vasDollyCodec) encode(info ChannelInfo) ([]byte, error) {
+	if len(info.Extras) != 0 {
+		return nil, fmt.Errorf("channel %s has extras, which cannot be written in format %s", info.Channel, FormatVasDolly)
+	}
+	if len(info.Channel) == 0 {
+		return nil, fmt.Errorf("no channel to write in format %s", FormatVasDolly)
+	}
+	return []byte(info.Channel), nil
+}
+
+func (vasDollyCodec) decode(value []byte) (c ChannelInfo, err error) {
+	if !utf8.Valid(value) {
+		return c, fmt.Errorf("%w, channel of %s is not in UTF-8", ErrInvalidPayload, FormatVasDolly)
+	}
+	c.Channel = string(value)
+	return c, nil
+}
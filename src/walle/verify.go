@@ -0,0 +1,192 @@
+package walle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+)
+
+// verifyChannelApk re-opens the generated output and checks it against the sections z
+// which it was generated from and the sections written which were written into it:
+//   - EOCD and APK Signing Block can be parsed again, and are the ones written
+//   - the channel payload is the one written byte by byte, which is decoded by codec into info
+//   - bytes before APK Signing Block, the original ID-value pairs except the ones in drop
+//     and the verity padding, and the central directory are identical to input
+func verifyChannelApk(z zipSections, written *zipSections, output string, info ChannelInfo, codec channelCodec, drop []uint32) error {
+	payload, err := writtenPayload(written.signingBlock, info, codec)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Open(output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	fi, err := out.Stat()
+	if err != nil {
+		return err
+	}
+
+	eocd, eocdOffset, err := findEndOfCentralDirectoryRecord(out, fi.Size())
+	if err != nil {
+		return err
+	}
+	if eocd == nil {
+		return fmt.Errorf("%w in %s", ErrNoEOCD, output)
+	}
+	if eocdOffset+int64(len(eocd)) != fi.Size() {
+		return fmt.Errorf("EOCD record ends at %d, but file size is %d", eocdOffset+int64(len(eocd)), fi.Size())
+	}
+	if !bytes.Equal(eocd, written.eocd) {
+		return fmt.Errorf("EOCD record mismatched! Expect %x, but %x", written.eocd, eocd)
+	}
+	centralDirOffset, centralDirSize, err := eocdCentralDirectory(eocd, eocdOffset)
+	if err != nil {
+		return err
+	}
+	if centralDirSize != uint32(len(z.centraDir)) {
+		return fmt.Errorf("central directory size mismatched! Expect %d, but %d", len(z.centraDir), centralDirSize)
+	}
+	if int64(centralDirOffset)+int64(centralDirSize) != eocdOffset {
+		return fmt.Errorf("central directory [%d, %d) is not followed by EOCD at %d",
+			centralDirOffset, int64(centralDirOffset)+int64(centralDirSize), eocdOffset)
+	}
+
+	block, blockOffset, err := findApkSigningBlock(out, centralDirOffset)
+	if err != nil {
+		return err
+	}
+	if blockOffset != z.signingBlockOffset {
+		return fmt.Errorf("APK Signing Block offset mismatched! Expect %d, but %d", z.signingBlockOffset, blockOffset)
+	}
+	if err = verifySigningBlockEntries(z.signingBlock, block, payload, codec.blockId(), drop); err != nil {
+		return err
+	}
+
+	if err = compareSections(z.source, out, 0, blockOffset); err != nil {
+		return fmt.Errorf("bytes before APK Signing Block: %s", err)
+	}
+	if err = compareSections(bytes.NewReader(z.centraDir), io.NewSectionReader(out, int64(centralDirOffset), int64(centralDirSize)),
+		0, int64(centralDirSize)); err != nil {
+		return fmt.Errorf("central directory: %s", err)
+	}
+	return nil
+}
+
+// writtenPayload returns the channel payload in the APK Signing Block written, which must be
+// decoded by codec into info. The payload is compared with the output as it is rather than
+// encoded again, so that verifying never depends on how info is encoded.
+func writtenPayload(block []byte, info ChannelInfo, codec channelCodec) ([]byte, error) {
+	m, err := findIdValuesInApkSigningBlock(block, codec.blockId())
+	if err != nil {
+		return nil, err
+	}
+	payload, ok := m[codec.blockId()]
+	if !ok {
+		return nil, ErrNoChannel
+	}
+	c, err := codec.decode(payload)
+	if err != nil {
+		return nil, err
+	}
+	if !sameChannelInfo(c, info) {
+		return nil, fmt.Errorf("channel payload %s is not channel %s", payload, info.String())
+	}
+	return payload, nil
+}
+
+// sameChannelInfo reports whether a and b hold the same channel and extras.
+func sameChannelInfo(a, b ChannelInfo) bool {
+	if a.Channel != b.Channel || len(a.Extras) != len(b.Extras) {
+		return false
+	}
+	for k, v := range a.Extras {
+		if w, ok := b.Extras[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// verifySigningBlockEntries checks that newBlock holds the same ID-value pairs as origin
+// in the same order except the ones in drop, plus the pair of blockId whose value is payload.
+// The verity padding is resized along with the block, so it is skipped.
+func verifySigningBlockEntries(origin, newBlock, payload []byte, blockId uint32, drop []uint32) error {
+	var originValues [][]byte
+	err := walkApkSigningBlock(origin, func(id uint32, value []byte) {
+		if id != blockId && id != APK_VERITY_PADDING_BLOCK_ID && !isExpected(drop, id) {
+			originValues = append(originValues, idValueBytes(id, value))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	var channel []byte
+	i, changed := 0, false
+	err = walkApkSigningBlock(newBlock, func(id uint32, value []byte) {
+		if id == blockId {
+			channel = value
+			return
+		}
+		if id == APK_VERITY_PADDING_BLOCK_ID {
+			return
+		}
+		if i < len(originValues) && bytes.Equal(originValues[i], idValueBytes(id, value)) {
+			i++
+		} else {
+			changed = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if changed || i != len(originValues) {
+		return fmt.Errorf("original ID-value pairs of APK Signing Block are changed")
+	}
+	if channel == nil {
+		return ErrNoChannel
+	}
+	if !bytes.Equal(channel, payload) {
+		return fmt.Errorf("channel payload mismatched! Expect %s, but %s", payload, channel)
+	}
+	return nil
+}
+
+func idValueBytes(id uint32, value []byte) []byte {
+	b := make([]byte, 4+len(value))
+	putUint32(id, b, 0)
+	copy(b[4:], value)
+	return b
+}
+
+// compareSections compares [offset, offset+size) of a and b by their SHA-256 digests,
+// both sections are streamed rather than loaded into memory.
+func compareSections(a, b io.ReaderAt, offset, size int64) error {
+	da, err := hashSection(a, offset, size)
+	if err != nil {
+		return err
+	}
+	db, err := hashSection(b, offset, size)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(da, db) {
+		return fmt.Errorf("sha256 mismatched! Expect %x, but %x", da, db)
+	}
+	return nil
+}
+
+func hashSection(r io.ReaderAt, offset, size int64) ([]byte, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, io.NewSectionReader(r, offset, size))
+	if err != nil {
+		return nil, err
+	}
+	if n != size {
+		return nil, fmt.Errorf("read bytes count mismatched! Expect %d, but %d", size, n)
+	}
+	return h.Sum(nil), nil
+}
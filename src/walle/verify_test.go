@@ -0,0 +1,93 @@
+package walle
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestGenerateVerify generates apks with several extras, whose payloads must be verified
+// against the bytes written whatever order their keys are in.
+func TestGenerateVerify(t *testing.T) {
+	for _, format := range []ChannelFormat{FormatWalle, FormatPackerNg} {
+		t.Run(string(format), func(t *testing.T) {
+			extras := map[string]string{
+				"zeta": "1", "alpha": "2", "url": "https://example.com/?a=1&b=2",
+				"k": "v", "tags": "a,b", "name": "美团",
+			}
+			dir := t.TempDir()
+			base := testSignedApk(t, dir)
+			infos := []ChannelInfo{{Channel: "meituan", Extras: extras}, {Channel: "huawei", Extras: extras}}
+			generated, err := Generate(context.Background(), base, dir, infos, GenerateOptions{Verify: true, Format: format})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(generated) != len(infos) {
+				t.Fatalf("%d apks generated, want %d", len(generated), len(infos))
+			}
+			for i, g := range generated {
+				c, err := ReadChannelInfo(g.Output, ReadOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !sameChannelInfo(c, infos[i]) {
+					t.Errorf("channel of %s is %s, want %s", g.Output, c.String(), infos[i].String())
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyChannelApk(t *testing.T) {
+	dir := t.TempDir()
+	base := testSignedApk(t, dir)
+	f, err := os.Open(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := newZipSections(f, fi.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := ChannelInfo{Channel: "meituan", Extras: map[string]string{"a": "1", "b": "2", "c": "3"}}
+	output := filepath.Join(dir, "meituan.apk")
+	written, err := gen(context.Background(), info, z, output, walleCodec{}, nil, false, nil, nil, nopLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyChannelApk(z, written, output, info, walleCodec{}, nil); err != nil {
+		t.Fatalf("apk written is not verified, %s", err)
+	}
+	if err = verifyChannelApk(z, written, output, ChannelInfo{Channel: "meituan"}, walleCodec{}, nil); err == nil {
+		t.Error("no error for other channel info")
+	}
+
+	// the payload is rewritten with its keys in another order
+	b, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := info.Bytes()
+	i := bytes.Index(b, payload)
+	if i < 0 {
+		t.Fatal("no payload in apk written")
+	}
+	reordered := []byte(`{"c":"3","b":"2","a":"1","channel":"meituan"}`)
+	if len(reordered) != len(payload) {
+		t.Fatalf("reordered payload is %d bytes, want %d", len(reordered), len(payload))
+	}
+	copy(b[i:], reordered)
+	if err = os.WriteFile(output, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyChannelApk(z, written, output, info, walleCodec{}, nil); err == nil {
+		t.Error("no error for payload which is not the one written")
+	}
+}
@@ -0,0 +1,221 @@
+package walle
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// variables so that tests can shorten them
+var (
+	_WATCH_POLL_INTERVAL = 2 * time.Second
+	// an apk is considered fully written once its size and modification time are unchanged
+	// for this long
+	_WATCH_SETTLE_TIME = 3 * time.Second
+)
+
+// Watch watches dir for new apks and generates all channels in config for each of them into
+// dir out, like `walle-cli gen`.
+//
+// An apk is processed only after it is fully written, i.e. its size has settled. Then it is
+// moved into dir/done, or dir/failed if generating failed, so that it is processed only once;
+// a number is appended to its name if the one of an earlier apk is taken, e.g. app-1.apk. An
+// apk which cannot be moved is ignored until it changes.
+// Errors are logged into opts.Logger and never stop watching, Watch only returns if dir cannot be watched,
+// channels in config are invalid, or ctx is done, when ctx.Err() is returned.
+//
+// New files are noticed by inotify on Linux, and by polling dir on other systems or if
+// inotify is unavailable.
+func Watch(ctx context.Context, dir, out string, config *ChannelConfig, opts GenerateOptions) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a dir", dir)
+	}
+	done, failed := filepath.Join(dir, "done"), filepath.Join(dir, "failed")
+	for _, d := range []string{done, failed} {
+		if err = os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+	// generated apks must not be written into dir, or they are watched as new apks
+	if len(out) == 0 || sameFile(out, dir) {
+		return fmt.Errorf("output dir must be specified and differ from %s", dir)
+	}
+	if err = os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+	infos := config.ChannelInfos()
+	channels := make([]string, len(infos))
+	for i, info := range infos {
+		channels[i] = info.Channel
+	}
+	if err = ValidateChannels(channels, opts.ChannelPattern); err != nil {
+		return err
+	}
+	if opts.Aliases == nil {
+		opts.Aliases = config.Aliases()
+	}
+
+	logger := loggerOf(opts.Logger)
+	events, err := watchDir(ctx, dir)
+	if err != nil {
+		logger.Warn("fall back to polling", "dir", dir, "interval", _WATCH_POLL_INTERVAL, "err", err)
+	}
+	logger.Info("watching for new apks", "dir", dir)
+
+	w := newApkWatcher(dir)
+	for {
+		settled, err := w.scan(time.Now())
+		if err != nil {
+			logger.Error("cannot read dir", "dir", dir, "err", err)
+		}
+		for _, path := range settled {
+			dest, err := processWatchedApk(ctx, path, out, infos, opts, done, failed, logger)
+			if err != nil {
+				return err
+			}
+			if _, err = moveToDir(path, dest); err != nil {
+				// path would be processed again and again if it were still watched
+				logger.Error("cannot move apk, it is ignored until it changes", "input", path, "dir", dest, "err", err)
+				w.ignore(path)
+			}
+		}
+
+		var timeout <-chan time.Time
+		if events == nil || len(w.pending) != 0 {
+			// polling, or waiting for pending apks to settle
+			timeout = time.After(_WATCH_POLL_INTERVAL)
+		}
+		select {
+		case _, ok := <-events:
+			if !ok {
+				logger.Warn("inotify stopped, fall back to polling", "dir", dir, "interval", _WATCH_POLL_INTERVAL)
+				events = nil
+			}
+		case <-timeout:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// processWatchedApk generates channels of path, and returns the dir it is to be moved into,
+// done or failed. It returns ctx.Err() if canceled, then path is left in dir to be processed
+// again next time.
+func processWatchedApk(ctx context.Context, path, out string, infos []ChannelInfo, opts GenerateOptions, done, failed string, logger *slog.Logger) (string, error) {
+	start := time.Now()
+	generated, err := Generate(ctx, path, out, infos, opts)
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if err != nil {
+		logger.Error("generating channels failed", "input", path, "generated", len(generated), "err", err)
+		return failed, nil
+	}
+	logger.Info("generated channels", "input", path, "generated", len(generated), "elapsed", time.Since(start))
+	return done, nil
+}
+
+// moveToDir moves file path into dir and returns its new path. The name of path is kept
+// unless dir has a file of it, then a number is appended, e.g. app-1.apk, so that no earlier
+// apk in dir is overwritten.
+func moveToDir(path, dir string) (string, error) {
+	name := filepath.Base(path)
+	ext := filepath.Ext(name)
+	target := filepath.Join(dir, name)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		target = filepath.Join(dir, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), i, ext))
+	}
+	if err := os.Rename(path, target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// apkWatcher finds apks in dir which are fully written, i.e. whose size and modification
+// time are unchanged for _WATCH_SETTLE_TIME.
+type apkWatcher struct {
+	dir     string
+	pending map[string]watchedApk
+	ignored map[string]watchedApk // apks never settled again until they change
+}
+
+type watchedApk struct {
+	size    int64
+	modTime time.Time
+	since   time.Time // when size and modTime are observed unchanged since
+}
+
+func newApkWatcher(dir string) *apkWatcher {
+	return &apkWatcher{
+		dir:     dir,
+		pending: make(map[string]watchedApk),
+		ignored: make(map[string]watchedApk),
+	}
+}
+
+// scan reads dir at time now, and returns the apks settled. An apk returned is no longer
+// pending, it is pending again if it is still in dir at the next scan.
+func (w *apkWatcher) scan(now time.Time) ([]string, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	var settled []string
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.EqualFold(filepath.Ext(e.Name()), ".apk") {
+			continue
+		}
+		path := filepath.Join(w.dir, e.Name())
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		seen[path] = true
+		if s, ok := w.ignored[path]; ok {
+			if s.size == fi.Size() && s.modTime.Equal(fi.ModTime()) {
+				continue
+			}
+			delete(w.ignored, path)
+		}
+		s, ok := w.pending[path]
+		if !ok || s.size != fi.Size() || !s.modTime.Equal(fi.ModTime()) {
+			w.pending[path] = watchedApk{fi.Size(), fi.ModTime(), now}
+			continue
+		}
+		if now.Sub(s.since) < _WATCH_SETTLE_TIME {
+			continue
+		}
+		delete(w.pending, path)
+		settled = append(settled, path)
+	}
+	for _, m := range []map[string]watchedApk{w.pending, w.ignored} {
+		for path := range m {
+			if !seen[path] {
+				delete(m, path)
+			}
+		}
+	}
+	return settled, nil
+}
+
+// ignore stops settling path until its size or modification time changes.
+func (w *apkWatcher) ignore(path string) {
+	delete(w.pending, path)
+	if fi, err := os.Stat(path); err == nil {
+		w.ignored[path] = watchedApk{size: fi.Size(), modTime: fi.ModTime()}
+	}
+}
@@ -0,0 +1,63 @@
+//go:build linux
+
+package walle
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+)
+
+// watchDir notifies on the returned channel whenever a file is created in, moved into or
+// closed after writing in dir. The channel is closed if inotify stops working or ctx is done.
+func watchDir(ctx context.Context, dir string) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("cannot init inotify, %s", err)
+	}
+	_, err = syscall.InotifyAddWatch(fd, dir, syscall.IN_CREATE|syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("cannot watch %s by inotify, %s", dir, err)
+	}
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err == nil {
+		err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)})
+		if err != nil {
+			syscall.Close(epfd)
+		}
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("cannot wait for inotify, %s", err)
+	}
+	events := make(chan struct{}, 1)
+	go func() {
+		defer syscall.Close(fd)
+		defer syscall.Close(epfd)
+		var ready [1]syscall.EpollEvent
+		defer close(events)
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for ctx.Err() == nil {
+			// wait at most 1s for events, so that ctx is checked in time
+			if n, err := syscall.EpollWait(epfd, ready[:], 1000); err == syscall.EINTR || n == 0 {
+				continue
+			} else if err != nil {
+				return
+			}
+			n, err := syscall.Read(fd, buf)
+			if err == syscall.EINTR || err == syscall.EAGAIN {
+				continue
+			}
+			if err != nil || n <= 0 {
+				return
+			}
+			// events are not parsed, dir is scanned on every notification
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return events, nil
+}
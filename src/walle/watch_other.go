@@ -0,0 +1,13 @@
+//go:build !linux
+
+package walle
+
+import (
+	"context"
+	"errors"
+)
+
+// watchDir is not supported except on Linux, dir is polled instead.
+func watchDir(ctx context.Context, dir string) (<-chan struct{}, error) {
+	return nil, errors.New("watching dir is not supported on this system")
+}
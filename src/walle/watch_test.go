@@ -0,0 +1,214 @@
+package walle
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApkWatcherScan(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	a, b := write("a.apk", "a"), write("B.APK", "b")
+	write("c.txt", "c")
+	if err := os.Mkdir(filepath.Join(dir, "d.apk"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newApkWatcher(dir)
+	t0 := time.Now()
+	scan := func(d time.Duration, want ...string) {
+		t.Helper()
+		got, err := w.scan(t0.Add(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("settled %v at %v, want %v", got, d, want)
+		}
+	}
+	scan(0)
+	scan(_WATCH_SETTLE_TIME - 1)
+
+	// a is still being written, its settle time starts over
+	write("a.apk", "aa")
+	scan(_WATCH_SETTLE_TIME, b)
+	scan(_WATCH_SETTLE_TIME + 1)
+	scan(2*_WATCH_SETTLE_TIME, a)
+
+	// both are still in dir, they are pending again
+	scan(2*_WATCH_SETTLE_TIME+1, b)
+	scan(3*_WATCH_SETTLE_TIME+1, a)
+
+	// a cannot be moved, so it is ignored until it changes, b is removed
+	w.ignore(a)
+	if err := os.Remove(b); err != nil {
+		t.Fatal(err)
+	}
+	scan(4 * _WATCH_SETTLE_TIME)
+	scan(6 * _WATCH_SETTLE_TIME)
+	if len(w.pending) != 0 {
+		t.Fatalf("pending %v, want none", w.pending)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(a, later, later); err != nil {
+		t.Fatal(err)
+	}
+	scan(7 * _WATCH_SETTLE_TIME)
+	scan(8*_WATCH_SETTLE_TIME, a)
+	if len(w.ignored) != 0 {
+		t.Fatalf("ignored %v, want none", w.ignored)
+	}
+
+	// an ignored apk removed is forgotten
+	w.ignore(a)
+	if err := os.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	scan(9 * _WATCH_SETTLE_TIME)
+	if len(w.ignored) != 0 {
+		t.Fatalf("ignored %v, want none", w.ignored)
+	}
+
+	if _, err := newApkWatcher(filepath.Join(dir, "missing")).scan(t0); err == nil {
+		t.Fatal("scanned a missing dir")
+	}
+}
+
+func TestMoveToDir(t *testing.T) {
+	dir, dest := t.TempDir(), t.TempDir()
+	var got []string
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(dir, "app.apk")
+		if err := os.WriteFile(path, []byte{byte(i)}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		target, err := moveToDir(path, dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s is not moved, %v", path, err)
+		}
+		got = append(got, filepath.Base(target))
+	}
+	if want := []string{"app.apk", "app-1.apk", "app-2.apk"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("moved to %v, want %v", got, want)
+	}
+	for i, name := range got {
+		data, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != 1 || data[0] != byte(i) {
+			t.Fatalf("%s is overwritten, %v", name, data)
+		}
+	}
+
+	path := filepath.Join(dir, "noext")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dest, "noext"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := moveToDir(path, dest); err != nil || filepath.Base(target) != "noext-1" {
+		t.Fatalf("moved to %s, %v, want noext-1", target, err)
+	}
+
+	// dest is not a dir
+	path = filepath.Join(dir, "app.apk")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := moveToDir(path, filepath.Join(dest, "app.apk")); err == nil {
+		t.Fatal("moved into a file")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("%s is lost after a failed move, %v", path, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	poll, settle := _WATCH_POLL_INTERVAL, _WATCH_SETTLE_TIME
+	_WATCH_POLL_INTERVAL, _WATCH_SETTLE_TIME = 10*time.Millisecond, 50*time.Millisecond
+	defer func() {
+		_WATCH_POLL_INTERVAL, _WATCH_SETTLE_TIME = poll, settle
+	}()
+
+	tmp := t.TempDir()
+	base, err := os.ReadFile(testSignedApk(t, tmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, out := filepath.Join(tmp, "in"), filepath.Join(tmp, "out")
+	done, failed := filepath.Join(dir, "done"), filepath.Join(dir, "failed")
+	if err = os.MkdirAll(done, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// an apk processed earlier of the same name
+	if err = os.WriteFile(filepath.Join(done, "app.apk"), []byte("earlier"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "app.apk"), base, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "broken.apk"), []byte("not an apk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ChannelConfig{ChannelInfoList: []ChannelConfigEntry{{Channel: "meituan"}, {Channel: "huawei"}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- Watch(ctx, dir, out, config, GenerateOptions{})
+	}()
+	wait := func(path string) {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if _, err := os.Stat(path); err == nil {
+				return
+			}
+		}
+		t.Fatalf("%s is not created", path)
+	}
+	wait(filepath.Join(done, "app-1.apk"))
+	wait(filepath.Join(failed, "broken.apk"))
+	cancel()
+	if err = <-errc; err != context.Canceled {
+		t.Fatalf("Watch returned %v, want %v", err, context.Canceled)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(done, "app.apk")); err != nil || string(data) != "earlier" {
+		t.Fatalf("earlier apk is overwritten, %q, %v", data, err)
+	}
+	entries, err := os.ReadDir(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d apks generated, want 2", len(entries))
+	}
+	for _, e := range entries {
+		c, err := ReadChannelInfo(filepath.Join(out, e.Name()), ReadOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Channel != "meituan" && c.Channel != "huawei" {
+			t.Fatalf("%s has channel %q", e.Name(), c.Channel)
+		}
+	}
+
+	if err = Watch(context.Background(), dir, dir, config, GenerateOptions{}); err == nil {
+		t.Fatal("watched with output into the watched dir")
+	}
+}
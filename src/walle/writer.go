@@ -1,14 +1,21 @@
 package walle
 
 import (
+	"context"
+	"crypto"
+	"errors"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"regexp"
 	"fmt"
 	"time"
+	"strings"
 )
 
 type zipSections struct {
-	beforeSigningBlock []byte
+	source             io.ReaderAt // bytes before APK Signing Block are read from here
 	signingBlock       []byte
 	signingBlockOffset int64
 	centraDir          []byte
@@ -18,42 +25,163 @@ type zipSections struct {
 }
 type transform func(*zipSections) (*zipSections, error)
 
-func (z *zipSections) writeTo(output string, transform transform) (err error) {
-	f, err := os.Create(output)
+// writeTo writes the transformed zip into output and returns it, sums, if not nil, are computed
+// while writing. Output is written atomically, an existing output is replaced only after the new one is complete.
+// Writing stops with ctx.Err() once ctx is done, and the incomplete output is removed.
+// progress, if not nil, is called with bytes written so far and size of output after every write.
+func (z *zipSections) writeTo(ctx context.Context, output string, transform transform, sums *checksums, progress func(written, size int64)) (*zipSections, error) {
+	newZip, err := transform(z)
 	if err != nil {
-		return
+		return nil, err
+	}
+	r := newZip.reader()
+	err = writeFile(output, func(w io.Writer) error {
+		if progress != nil {
+			w = &progressWriter{w: w, size: r.Size(), progress: progress}
+		}
+		if sums != nil && len(sums.hashes) != 0 {
+			writers := []io.Writer{w}
+			for _, h := range sums.hashes {
+				writers = append(writers, h)
+			}
+			w = io.MultiWriter(writers...)
+		}
+		_, err := io.Copy(ctxWriter{ctx, w}, r)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return newZip, nil
+}
 
-	defer f.Close()
+type progressWriter struct {
+	w        io.Writer
+	written  int64
+	size     int64
+	progress func(written, size int64)
+}
 
-	newZip, err := transform(z)
-	if err != nil {
-		return
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	w.progress(w.written, w.size)
+	return n, err
+}
+
+// ctxWriter fails writing once ctx is done, so that a long copy stops soon after canceled.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w ctxWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
 	}
+	return w.w.Write(p)
+}
 
-	for _, s := range [][]byte{
-			newZip.beforeSigningBlock,
-			newZip.signingBlock,
-			newZip.centraDir,
-			newZip.eocd} {
-		_, err := f.Write(s)
-		if err != nil {
-			return err
-		}
+// GenerateOptions controls how channel apks are generated.
+type GenerateOptions struct {
+	Force    bool              // overwrite exist channel apks in output
+	Verify   bool              // re-read and check every output after it has been written
+	Manifest string            // json file to record generated apks in, see Manifest
+	Aliases  map[string]string // aliases of channels, which are recorded in manifest only
+
+	// Format is the format of channels written, FormatWalle if empty.
+	Format ChannelFormat
+
+	// ChannelPattern is the pattern of valid channels, DefaultChannelPattern if nil.
+	// See ValidateChannels.
+	ChannelPattern *regexp.Regexp
+
+	// Checksums are algorithms of checksum files of outputs: sha256, sha1 or md5.
+	// Checksums are computed while writing outputs, and written in the format of coreutils.
+	Checksums       []string
+	ChecksumSidecar bool // write <output>.<algorithm> beside each output
+	ChecksumSums    bool // write <ALGORITHM>SUMS of all outputs into dir out
+
+	// Progress, if not nil, is called with events of generating, see ProgressPrinter.
+	// It is called on the goroutine calling Generate.
+	Progress func(GenerateEvent)
+
+	// V4, if true, regenerates the v4 signature <output>.idsig of each output from the one of
+	// input, which is re-signed by V4Key, the key of it. Without V4, the v4 signature of input
+	// is ignored with a warning, since it is invalid for channel apks.
+	V4    bool
+	V4Key crypto.Signer
+
+	// StripSourceStamp and StripDependencyInfo remove the source stamp and the dependency
+	// info, the metadata for Google Play only, from APK Signing Block of outputs, since some
+	// third-party stores reject apks carrying them. Both are preserved by default, neither
+	// of them is covered by the v2 or v3 signature.
+	StripSourceStamp    bool
+	StripDependencyInfo bool
+
+	// Logger, if not nil, logs details of generating at debug level, e.g. sections of input
+	// and time consumed by each channel, and errors which are not returned.
+	Logger *slog.Logger
+}
+
+// strippedIds returns IDs of the ID-value pairs removed from APK Signing Block of outputs.
+func (o GenerateOptions) strippedIds() []uint32 {
+	var ids []uint32
+	if o.StripSourceStamp {
+		ids = append(ids, APK_SOURCE_STAMP_V1_BLOCK_ID, APK_SOURCE_STAMP_V2_BLOCK_ID)
 	}
-	return
+	if o.StripDependencyInfo {
+		ids = append(ids, APK_DEPENDENCY_INFO_BLOCK_ID)
+	}
+	return ids
+}
+
+// GeneratedApk is a channel apk generated by Generate.
+type GeneratedApk struct {
+	Channel string
+	Output  string
+}
+
+// GenerateChannelApk generates apks with channels into dir out, and returns the apks
+// generated, see Generate.
+// If opts.Verify is true, every output is re-read and checked against input after it has
+// been written, outputs that failed on checking will be removed and reported.
+// If ctx is canceled, generating stops with ctx.Err() and the apks completed are returned.
+// Nothing is printed on success, set opts.Progress to ProgressPrinter to print progress.
+func GenerateChannelApk(ctx context.Context, out string, channels []string, extras map[string]string, input string, opts GenerateOptions) ([]GeneratedApk, error) {
+	if len(channels) == 0 {
+		return nil, errors.New("no channel specified!")
+	}
+	infos := make([]ChannelInfo, len(channels))
+	for i, channel := range channels {
+		infos[i] = ChannelInfo{Channel: channel, Extras: extras}
+	}
+	return Generate(ctx, input, out, infos, opts)
 }
 
-var _debug bool
+// GenerateChannelApkWithConfig generates apks with all channels in config into dir out,
+// aliases of channels in config are recorded in manifest if opts.Manifest is set.
+func GenerateChannelApkWithConfig(ctx context.Context, out string, config *ChannelConfig, input string, opts GenerateOptions) ([]GeneratedApk, error) {
+	if opts.Aliases == nil {
+		opts.Aliases = config.Aliases()
+	}
+	return Generate(ctx, input, out, config.ChannelInfos(), opts)
+}
 
-func GenerateChannelApk(out string, channels []string, extras map[string]string, input string, force bool, debug bool) {
-	_debug = debug
+// Generate generates apks of input with infos into dir out, dir of input by default, and
+// returns the apks generated.
+// It stops on the first error of generating, while failures of verifying are collected
+// and reported together after all channels are done.
+// It stops with ctx.Err() once ctx is done, the apk being written is removed, and the apks
+// generated before are returned.
+// The manifest and checksums, if any, are written with apks generated before stopping.
+func Generate(ctx context.Context, input, out string, infos []ChannelInfo, opts GenerateOptions) (generated []GeneratedApk, err error) {
 	if len(input) == 0 {
-		exit("Error: no input file specified!")
+		return nil, errors.New("no input file specified!")
 	}
 
 	if _, err := os.Stat(input); os.IsNotExist(err) {
-		exitf("Error: no such file %s!", input)
+		return nil, fmt.Errorf("no such file %s!", input)
 	}
 
 	if len(out) == 0 {
@@ -61,57 +189,200 @@ func GenerateChannelApk(out string, channels []string, extras map[string]string,
 	} else {
 		fi, err := os.Stat(out)
 		if os.IsNotExist(err) || !fi.IsDir() {
-			exitf("Error: output %s is neither exist nor a dir!", out)
+			return nil, fmt.Errorf("output %s is neither exist nor a dir!", out)
 		}
 	}
-	if len(channels) == 0 {
-		exit("Error: no channel specified!")
+	if len(infos) == 0 {
+		return nil, errors.New("no channel specified!")
+	}
+	if err := ValidateChecksumAlgorithms(opts.Checksums); err != nil {
+		return nil, err
+	}
+	channels := make([]string, len(infos))
+	for i, info := range infos {
+		channels[i] = info.Channel
+	}
+	if err := ValidateChannels(channels, opts.ChannelPattern); err != nil {
+		return nil, err
+	}
+	codec, err := codecOf(opts.Format)
+	if err != nil {
+		return nil, err
 	}
+	for _, info := range infos {
+		if _, err := codec.encode(info); err != nil {
+			return nil, err
+		}
+	}
+	logger := loggerOf(opts.Logger)
 	//TODO: add new option for generating new channel from channelled apk
-	if c, _ := readChannelInfo(input); len(c.Channel) != 0 {
-		exitf("Error: file %s is registered a channel block %s", filepath.Base(input), c.String())
+	if c, err := readChannelInfo(input, logger); err != nil {
+		return nil, fmt.Errorf("cannot parse apk %s, %w", input, err)
+	} else if len(c.Channel) != 0 {
+		return nil, fmt.Errorf("file %s is registered a channel block %s", filepath.Base(input), c.String())
 	}
-	var start time.Time
-	if _debug {
-		start = time.Now()
+
+	var v4 *v4Signature
+	if idsig := v4SignatureFile(input); !isRegularFile(idsig) {
+		if opts.V4 {
+			return nil, fmt.Errorf("no v4 signature %s to regenerate", idsig)
+		}
+	} else if !opts.V4 {
+		logger.Warn("v4 signature is invalid for channel apks and not regenerated", "idsig", idsig)
+	} else if v4, err = readV4Signature(idsig); err != nil {
+		return nil, err
+	} else if err = v4.checkKey(opts.V4Key); err != nil {
+		return nil, fmt.Errorf("cannot regenerate v4 signature %s, %s", idsig, err)
 	}
 
-	fmt.Printf("Generating channels %s for %s into dir %s ...\n", channels, filepath.Base(input), out)
-	z, err := newZipSections(input)
+	in, err := os.Open(input)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open apk %s, %s", input, err)
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open apk %s, %s", input, err)
+	}
+	z, err := newZipSections(in, fi.Size())
 	if err != nil {
-		exitf("Error occurred on parsing apk %s, %s\n", input, err)
+		return nil, fmt.Errorf("cannot parse apk %s, %w", input, err)
 	}
+	logger.Debug("parsed apk", "input", input, "size", fi.Size(), "sections", z)
+	start := time.Now()
+	emit := func(e GenerateEvent) {
+		if opts.Progress != nil {
+			e.Input, e.Total = input, len(infos)
+			opts.Progress(e)
+		}
+	}
+	emit(GenerateEvent{Type: GenerateStarted})
+	// deferred before writing manifest and checksums, so that it is called after them
+	defer func() {
+		emit(GenerateEvent{Type: GenerateFinished, Index: len(generated), Err: err})
+		logger.Debug("finished generating", "input", input, "generated", len(generated), "total", len(infos),
+			"elapsed", time.Since(start), "err", err)
+	}()
+	var manifest *manifestWriter
+	if len(opts.Manifest) != 0 {
+		// input is hashed for manifest while it is streamed into outputs
+		src := newHashingReaderAt(in)
+		z.source = src
+		if manifest, err = newManifestWriter(opts.Manifest, input, src, fi.Size(), opts.Aliases); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if e := manifest.write(); e != nil && err == nil {
+				err = fmt.Errorf("cannot write manifest %s, %s", opts.Manifest, e)
+			}
+		}()
+	}
+	algorithms := newChecksums(opts.Checksums).algorithms
+	if !opts.ChecksumSidecar && !opts.ChecksumSums {
+		algorithms = nil
+	}
+	// manifest records SHA-256 of outputs, which is computed along with checksums
+	computed := algorithms
+	if manifest != nil {
+		computed = append([]string{"sha256"}, algorithms...)
+	}
+	var outputs []string
+	var outputSums []*checksums
+	if opts.ChecksumSums {
+		defer func() {
+			// written even if canceled, as a summary of the apks generated
+			if e := writeChecksumsFiles(out, outputs, outputSums, algorithms); e != nil && err == nil {
+				err = fmt.Errorf("cannot write checksums, %s", e)
+			}
+		}()
+	}
+	drop := opts.strippedIds()
 	name, ext := fileNameAndExt(input)
-	for _, channel := range channels {
-		output := filepath.Join(out, name+"-"+channel+ext)
-		c := ChannelInfo{Channel: channel, Extras: extras}
-		err = gen(c, z, output, force)
+	var failed []string
+	for i, c := range infos {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		output := filepath.Join(out, name+"-"+ChannelFileName(c.Channel)+ext)
+		emit(GenerateEvent{Type: GenerateChannelBegin, Index: i, Channel: c.Channel, Output: output})
+		var progress func(written, size int64)
+		if opts.Progress != nil {
+			progress = func(written, size int64) {
+				emit(GenerateEvent{Type: GenerateBytesWritten, Index: i, Channel: c.Channel, Output: output, Written: written, Size: size})
+			}
+		}
+		sums := newChecksums(computed)
+		s := time.Now()
+		var written *zipSections
+		written, err = gen(ctx, c, z, output, codec, drop, opts.Force, sums, progress, logger)
+		write := time.Since(s)
 		if err != nil {
-			exitf("Error occurred on generating channel %s, %s\n", channel, err)
+			if ctx.Err() != nil {
+				return generated, ctx.Err()
+			}
+			err = fmt.Errorf("cannot generate channel %s, %s", c.Channel, err)
+			emit(GenerateEvent{Type: GenerateChannelFailed, Index: i, Channel: c.Channel, Output: output, Err: err})
+			return generated, err
+		}
+		var verify time.Duration
+		if opts.Verify {
+			s = time.Now()
+			err = verifyChannelApk(z, written, output, c, codec, drop)
+			verify = time.Since(s)
+			if err != nil {
+				logger.Debug("verifying failed", "channel", c.Channel, "output", output, "write", write, "verify", verify, "err", err)
+				emit(GenerateEvent{Type: GenerateChannelFailed, Index: i, Channel: c.Channel, Output: output, Err: fmt.Errorf("verifying failed, %s", err)})
+				if err = os.Remove(output); err != nil {
+					logger.Error("cannot remove apk failed on verifying", "output", output, "err", err)
+				}
+				failed = append(failed, c.Channel)
+				if manifest != nil {
+					manifest.fail(c)
+				}
+				continue
+			}
+		}
+		logger.Debug("generated channel", "channel", c.Channel, "output", output, "write", write, "verify", verify)
+		if v4 != nil {
+			if err = v4.regenerate(output, opts.V4Key); err != nil {
+				return generated, fmt.Errorf("cannot regenerate v4 signature of %s, %s", output, err)
+			}
+		}
+		if opts.ChecksumSidecar {
+			if err = writeChecksumSidecars(output, sums, algorithms); err != nil {
+				return generated, fmt.Errorf("cannot write checksums of %s, %s", output, err)
+			}
+		}
+		generated = append(generated, GeneratedApk{c.Channel, output})
+		emit(GenerateEvent{Type: GenerateChannelDone, Index: i, Channel: c.Channel, Output: output})
+		outputs = append(outputs, output)
+		outputSums = append(outputSums, sums)
+		if manifest != nil {
+			if err = manifest.add(output, c, sums.sum("sha256")); err != nil {
+				return generated, err
+			}
 		}
 	}
-	if _debug {
-		println("Consume", time.Since(start).String())
-	} else {
-		println("Done!")
+	if len(failed) != 0 {
+		return generated, fmt.Errorf("%d of %d channel(s) failed on verifying: %s", len(failed), len(infos), strings.Join(failed, ","))
 	}
-
+	return generated, nil
 }
 
-func newZipSections(input string) (z zipSections, err error) {
-	in, err := os.Open(input)
+// Parse sections of the zip in with size bytes, in must be kept open while using the sections.
+func newZipSections(in io.ReaderAt, size int64) (z zipSections, err error) {
+	// read eocd
+	eocd, eocdOffset, err := findEndOfCentralDirectoryRecord(in, size)
 	if err != nil {
 		return
 	}
-	defer in.Close()
-
-	// read eocd
-	eocd, eocdOffset, err := findEndOfCentralDirectoryRecord(in)
+	if eocd == nil {
+		return z, ErrNoEOCD
+	}
+	centralDirOffset, centralDirSize, err := eocdCentralDirectory(eocd, eocdOffset)
 	if err != nil {
 		return
 	}
-	centralDirOffset := getEocdCentralDirectoryOffset(eocd)
-	centralDirSize := getEocdCentralDirectorySize(eocd)
 	z.eocd = eocd
 	z.eocdOffset = eocdOffset
 	z.centralDirOffset = int64(centralDirOffset)
@@ -123,76 +394,55 @@ func newZipSections(input string) (z zipSections, err error) {
 	}
 	z.signingBlock = signingBlock
 	z.signingBlockOffset = signingBlockOffset
-	// read bytes before signing block
-	//TODO: waste too large memory
-	if signingBlockOffset >= 64 * 1024 * 1024 {
-		fmt.Print("Warning: maybe waste large memory on processing this apk! ")
-		fmt.Println("Before APK Signing Block bytes size is", signingBlockOffset/1024/1024, "MB")
-	}
-	beforeSigningBlock := make([]byte, signingBlockOffset)
-	n, err := in.ReadAt(beforeSigningBlock, 0)
-	if err != nil {
-		return
-	}
-	if int64(n) != signingBlockOffset {
-		return z, fmt.Errorf("Read bytes count mismatched! Expect %d, but %d", signingBlockOffset, n)
-	}
-	z.beforeSigningBlock = beforeSigningBlock
+	// bytes before signing block are streamed from source on writing
+	z.source = in
 
 	centralDir := make([]byte, centralDirSize)
-	n, err = in.ReadAt(centralDir, int64(centralDirOffset))
+	n, err := in.ReadAt(centralDir, int64(centralDirOffset))
 	if uint32(n) != centralDirSize {
 		return z, fmt.Errorf("Read bytes count mismatched! Expect %d, but %d", centralDirSize, n)
 	}
 	z.centraDir = centralDir
-	if _debug {
-		fmt.Printf("signingBlockOffset=%d, signingBlockLenth=%d\n"+
-			"centralDirOffset=%d, centralDirSize=%d\n"+
-			"eocdOffset=%d, eocdLenthe=%d\n",
-			signingBlockOffset,
-			len(signingBlock),
-			centralDirOffset,
-			centralDirSize,
-			eocdOffset,
-			len(eocd))
-	}
 	return
 }
 
-func gen(info ChannelInfo, sections zipSections, output string, force bool) (err error) {
+// gen writes the channel apk of info into output and returns the zip written.
+func gen(ctx context.Context, info ChannelInfo, sections zipSections, output string, codec channelCodec, drop []uint32, force bool, sums *checksums, progress func(written, size int64), logger *slog.Logger) (*zipSections, error) {
 
 	fi, err := os.Stat(output)
 	if err != nil && !os.IsNotExist(err) {
-		return err
+		return nil, err
 	}
 	if fi != nil {
 		if !force {
-			return fmt.Errorf("file already exists %s.", output)
+			return nil, fmt.Errorf("file already exists %s.", output)
 		}
-		println("Force generating channel", info.Channel)
+		logger.Debug("overwriting exist apk", "channel", info.Channel, "output", output)
 	}
 
-	var s time.Time
-	if _debug {
-		s = time.Now()
-	}
-	err = sections.writeTo(output, newTransform(info))
-	if _debug {
-		fmt.Printf("    write %s consume %s", output, time.Since(s).String())
-		fmt.Println()
-	}
-	return
+	return sections.writeTo(ctx, output, newTransform(info, codec, drop), sums, progress)
+}
+
+// newTransform returns the transform writing channel info by codec into APK Signing Block,
+// from which the ID-value pairs in drop are removed.
+func newTransform(info ChannelInfo, codec channelCodec, drop []uint32) transform {
+	return rebuildTransform(func(signingBlock []byte) ([]byte, int, error) {
+		return makeSigningBlockWithChannelInfo(info, codec, signingBlock, drop)
+	})
 }
 
-func newTransform(info ChannelInfo) transform {
+// rebuildTransform returns the transform replacing APK Signing Block with the one returned
+// by rebuild along with the size changed, and moving the offset of central directory in
+// EOCD by the size.
+func rebuildTransform(rebuild func(signingBlock []byte) ([]byte, int, error)) transform {
 	return func(zip *zipSections) (*zipSections, error) {
 
-		newBlock, diffSize, err := makeSigningBlockWithChannelInfo(info, zip.signingBlock)
+		newBlock, diffSize, err := rebuild(zip.signingBlock)
 		if err != nil {
 			return nil, err
 		}
 		newzip := new(zipSections)
-		newzip.beforeSigningBlock = zip.beforeSigningBlock
+		newzip.source = zip.source
 		newzip.signingBlock = newBlock
 		newzip.signingBlockOffset = zip.signingBlockOffset
 		newzip.centraDir = zip.centraDir
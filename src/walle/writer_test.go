@@ -0,0 +1,65 @@
+package walle
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateChannelApk(t *testing.T) {
+	dir := t.TempDir()
+	base := testSignedApk(t, dir)
+	extras := map[string]string{"k": "v"}
+	generated, err := GenerateChannelApk(context.Background(), dir, []string{"meituan", "huawei"}, extras, base, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generated) != 2 {
+		t.Fatalf("%d apks generated, want 2", len(generated))
+	}
+	for _, g := range generated {
+		c, err := ReadChannelInfo(g.Output, ReadOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Channel != g.Channel || c.Extras["k"] != "v" {
+			t.Fatalf("%s has channel %s", g.Output, c.String())
+		}
+	}
+
+	if _, err = GenerateChannelApk(context.Background(), dir, nil, nil, base, GenerateOptions{}); err == nil {
+		t.Fatal("generated without channels")
+	}
+	// an error is returned rather than exiting
+	if _, err = GenerateChannelApk(context.Background(), dir, []string{"meituan"}, nil, base, GenerateOptions{}); err == nil {
+		t.Fatal("overwrote an exist apk without Force")
+	}
+	if _, err = GenerateChannelApk(context.Background(), dir, []string{"a"}, nil, filepath.Join(dir, "missing.apk"), GenerateOptions{}); err == nil {
+		t.Fatal("generated from a missing apk")
+	}
+}
+
+func TestGenerateChannelApkCanceled(t *testing.T) {
+	dir := t.TempDir()
+	base := testSignedApk(t, dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := GenerateOptions{Progress: func(e GenerateEvent) {
+		if e.Type == GenerateChannelDone {
+			cancel()
+		}
+	}}
+	config := &ChannelConfig{ChannelInfoList: []ChannelConfigEntry{{Channel: "meituan"}, {Channel: "huawei"}}}
+	generated, err := GenerateChannelApkWithConfig(ctx, dir, config, base, opts)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("error %v, want %v", err, context.Canceled)
+	}
+	if len(generated) != 1 || generated[0].Channel != "meituan" {
+		t.Fatalf("generated %v, want meituan only", generated)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "base-huawei.apk")); !os.IsNotExist(err) {
+		t.Fatalf("apk of the channel canceled is left, %v", err)
+	}
+}
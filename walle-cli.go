@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
 	"flag"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"fmt"
 	"walle"
 	"strings"
 	"bytes"
 	"path/filepath"
+	"regexp"
+	"strconv"
 )
 
 type extraInfo map[string]string
@@ -16,12 +26,18 @@ type extraInfo map[string]string
 func (e *extraInfo) String() string {
 	return ""
 }
+
+// Repeated -e are merged, the later value wins if a key is given more than once.
 func (e *extraInfo) Set(val string) error {
-	pairs := strings.Split(val, ",")
-	*e = make(extraInfo)
-	for _, p := range pairs {
-		a := strings.Split(p, "=")
-		(*e)[a[0]] = a[1]
+	extras, err := walle.ParseExtras(val)
+	if err != nil {
+		return err
+	}
+	if *e == nil {
+		*e = make(extraInfo)
+	}
+	for k, v := range extras {
+		(*e)[k] = v
 	}
 	return nil
 }
@@ -38,30 +54,197 @@ func (c *channels) Set(val string) error {
 	return nil
 }
 
+// checksum algorithms, sha256, sha1 or md5
+type checksumAlgorithms []string
+
+// Default value of checksumAlgorithms
+func (c *checksumAlgorithms) String() string {
+	return ""
+}
+
+func (c *checksumAlgorithms) Set(val string) error {
+	var algorithms []string
+	for _, s := range strings.Split(val, ",") {
+		algorithms = append(algorithms, strings.ToLower(strings.TrimSpace(s)))
+	}
+	if err := walle.ValidateChecksumAlgorithms(algorithms); err != nil {
+		return err
+	}
+	*c = algorithms
+	return nil
+}
+
+// format of channels, see walle.ParseChannelFormat
+type channelFormat walle.ChannelFormat
+
+func (f *channelFormat) String() string {
+	return string(*f)
+}
+
+func (f *channelFormat) Set(val string) error {
+	format, err := walle.ParseChannelFormat(val)
+	if err != nil {
+		return err
+	}
+	*f = channelFormat(format)
+	return nil
+}
+
+// IDs of ID-value pairs in APK Signing Block, e.g. 0x71777777
+type blockIds []uint32
+
+// Default value of blockIds
+func (b *blockIds) String() string {
+	return ""
+}
+
+func (b *blockIds) Set(val string) error {
+	for _, s := range strings.Split(val, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(s), 0, 32)
+		if err != nil {
+			return fmt.Errorf("invalid ID %s, it must be a number like 0x71777777", s)
+		}
+		*b = append(*b, uint32(id))
+	}
+	return nil
+}
+
 var (
 	command     = filepath.Base(os.Args[0])
 	show        = flag.NewFlagSet("show", flag.ExitOnError)
 	gen         = flag.NewFlagSet("gen", flag.ExitOnError)
+	sign        = flag.NewFlagSet("sign", flag.ExitOnError)
+	serve       = flag.NewFlagSet("serve", flag.ExitOnError)
+	watch       = flag.NewFlagSet("watch", flag.ExitOnError)
+	check       = flag.NewFlagSet("check-manifest", flag.ExitOnError)
+	diff        = flag.NewFlagSet("diff", flag.ExitOnError)
+	strip       = flag.NewFlagSet("strip", flag.ExitOnError)
 	showRaw     bool
+	showDebug   bool
+	showSchemes bool
 	showHelp    bool
 	genOut      string
 	genChannels channels
 	genExtras   extraInfo
 	genForce    bool
 	genDebug    bool
+	genQuiet    bool
+	genVerify   bool
+	genConfig   string
+	genManifest string
+	genChecksum checksumAlgorithms
+	genSidecar  bool
+	genSums     bool
+	genPat      string
+	genV4       bool
+	genKey      string
+	genKs       string
+	genKsAlias  string
+	genKsPass   string
+	genKeyPass  string
+	genNoStamp  bool
+	genNoDeps   bool
+	genFormat   channelFormat
 	genHelp     bool
+	signKey     string
+	signCert    string
+	signOut     string
+	signV3      bool
+	signKs      string
+	signKsAlias string
+	signKsPass  string
+	signKeyPass string
+	signHelp    bool
+	serveBase   string
+	serveAddr   string
+	serveAllow  string
+	servePat    string
+	serveFormat channelFormat
+	serveHelp   bool
+	watchDir    string
+	watchConfig string
+	watchOut    string
+	watchForce  bool
+	watchVerify bool
+	watchPat    string
+	watchDebug  bool
+	watchQuiet  bool
+	watchHelp   bool
+	checkHelp   bool
+	diffJSON    bool
+	diffAll     bool
+	diffHelp    bool
+	stripKeep   blockIds
+	stripDrop   blockIds
+	stripOut    string
+	stripHelp   bool
 )
 
 func init() {
 
-	show.BoolVar(&showRaw, "r", false, "print `raw` text associated to id 0x71777777")
+	show.BoolVar(&showRaw, "r", false, "print `raw` text associated to id 0x71777777, or 0x881155ff of VasDolly, or 0x7a786b21 of packer-ng")
+	show.BoolVar(&showDebug, "v", false, "`verbose`, print debug log")
+	show.BoolVar(&showSchemes, "s", false, "print signature `schemes` v1, v2, v3, v3.1, v4, source stamp and dependency info, with warnings for channels")
 	show.BoolVar(&showHelp, "h", false, "print `help` message of show command")
 	gen.StringVar(&genOut, "o", "", "`output` dir, generated channel apk(s) will store in here. default is input's dir")
 	gen.Var(&genChannels, "c", "generate apk with the `channel(s)`, split multiple channels with ','")
-	gen.Var(&genExtras, "e", "generate apk with the `extras` info (key value pairs, e.g thing=test,boom=1)")
+	gen.Var(&genExtras, "e", "generate apk with the `extras` info (key value pairs, e.g thing=test,boom=1, or @extras.json, @extras.properties), can be repeated")
 	gen.BoolVar(&genHelp, "h", false, "print `help` message of gen command")
 	gen.BoolVar(&genForce, "f", false, "`force` to overwrite exist channeled apk in output")
-	gen.BoolVar(&genDebug, "d", false, "print `debug` log")
+	gen.BoolVar(&genDebug, "v", false, "`verbose`, print debug log, e.g. time consumed by each channel")
+	gen.BoolVar(&genDebug, "d", false, "print `debug` log, the same as -v")
+	gen.BoolVar(&genQuiet, "q", false, "`quiet`, print errors only")
+	sign.StringVar(&signKey, "key", "", "PEM encoded private `key` file (PKCS#1, PKCS#8 or EC)")
+	sign.StringVar(&signCert, "cert", "", "PEM encoded `certificate` chain file, the first one must match the key")
+	sign.StringVar(&signKs, "ks", "", "JKS or PKCS#12 `keystore` file, instead of -key and -cert")
+	sign.StringVar(&signKsAlias, "ks-alias", "", "`alias` of the private key in keystore, required if keystore holds more than one key")
+	sign.StringVar(&signKsPass, "ks-pass", "", "keystore `password`: pass:<password>, env:<name> or file:<path>")
+	sign.StringVar(&signKeyPass, "key-pass", "", "private key `password` in the same form as -ks-pass. default is keystore password")
+	sign.StringVar(&signOut, "o", "", "`output` file of signed apk. default is <input>-signed.apk in input's dir")
+	sign.BoolVar(&signV3, "v3", false, "also sign with APK Signature Scheme `v3`")
+	sign.BoolVar(&signHelp, "h", false, "print `help` message of sign command")
+	serve.StringVar(&serveBase, "base", "", "`base` apk which channel apks are generated from")
+	serve.StringVar(&serveAddr, "addr", ":8080", "`address` to listen on")
+	serve.StringVar(&serveAllow, "allow", "", "`allowlist` file of channels, one channel per line")
+	serveFormat = channelFormat(walle.FormatWalle)
+	serve.Var(&serveFormat, "format", "`format` of channels: walle, vasdolly or packerng, the same as gen")
+	serve.BoolVar(&serveHelp, "h", false, "print `help` message of serve command")
+	watch.StringVar(&watchDir, "dir", "", "`dir` to watch for new apks, processed apks are moved into its done/ or failed/")
+	watch.StringVar(&watchConfig, "config", "", "channel `config` json file, the same format as Java walle's")
+	watch.StringVar(&watchOut, "o", "", "`output` dir, generated channel apk(s) will store in here")
+	watch.BoolVar(&watchForce, "f", false, "`force` to overwrite exist channeled apk in output")
+	watch.BoolVar(&watchVerify, "verify", false, "`verify` every generated apk after writing, remove and report the broken one(s)")
+	watch.BoolVar(&watchDebug, "v", false, "`verbose`, print debug log")
+	watch.BoolVar(&watchQuiet, "q", false, "`quiet`, print errors only")
+	watch.BoolVar(&watchHelp, "h", false, "print `help` message of watch command")
+	gen.BoolVar(&genVerify, "verify", false, "`verify` every generated apk after writing, remove and report the broken one(s)")
+	gen.StringVar(&genConfig, "config", "", "channel `config` json file, the same format as Java walle's, instead of -c and -e")
+	gen.StringVar(&genManifest, "manifest", "", "write a `manifest` json file which records every generated apk")
+	genChecksum = checksumAlgorithms{"sha256"}
+	gen.Var(&genChecksum, "checksum", "checksum `algorithm(s)` of -sidecar and -sums: sha256, sha1 or md5, split multiple algorithms with ','. default is sha256")
+	gen.BoolVar(&genSidecar, "sidecar", false, "write checksum `sidecar` file <apk>.<algorithm> beside each generated apk")
+	gen.BoolVar(&genSums, "sums", false, "write checksum `list` file <ALGORITHM>SUMS of all generated apks into output dir")
+	gen.StringVar(&genPat, "channel-pattern", "", "regexp `pattern` of valid channels. default is "+walle.DefaultChannelPattern.String())
+	gen.BoolVar(&genV4, "v4", false, "regenerate `v4` signature <apk>.idsig of each generated apk from <input>.idsig, re-signed by -key or -ks")
+	gen.StringVar(&genKey, "key", "", "PEM encoded private `key` file of v4 signature, for -v4")
+	gen.StringVar(&genKs, "ks", "", "JKS or PKCS#12 `keystore` file of v4 signature, for -v4 instead of -key")
+	gen.StringVar(&genKsAlias, "ks-alias", "", "`alias` of the private key in keystore, required if keystore holds more than one key")
+	gen.StringVar(&genKsPass, "ks-pass", "", "keystore `password`: pass:<password>, env:<name> or file:<path>")
+	gen.StringVar(&genKeyPass, "key-pass", "", "private key `password` in the same form as -ks-pass. default is keystore password")
+	genFormat = channelFormat(walle.FormatWalle)
+	gen.Var(&genFormat, "format", "`format` of channels: walle, vasdolly of Tencent VasDolly, which holds no extras, or packerng of packer-ng-plugin")
+	gen.BoolVar(&genNoStamp, "strip-source-stamp", false, "strip source `stamp` blocks from APK Signing Block of generated apks")
+	gen.BoolVar(&genNoDeps, "strip-dependency-info", false, "strip `dependency` info block, the metadata for Google Play only, from APK Signing Block of generated apks")
+	serve.StringVar(&servePat, "channel-pattern", "", "regexp `pattern` of valid channels. default is "+walle.DefaultChannelPattern.String())
+	watch.StringVar(&watchPat, "channel-pattern", "", "regexp `pattern` of valid channels. default is "+walle.DefaultChannelPattern.String())
+	check.BoolVar(&checkHelp, "h", false, "print `help` message of check-manifest command")
+	diff.BoolVar(&diffJSON, "json", false, "print the difference in `json`")
+	diff.BoolVar(&diffAll, "a", false, "print `all` fields, including the same ones")
+	diff.BoolVar(&diffHelp, "h", false, "print `help` message of diff command")
+	strip.Var(&stripKeep, "keep", "keep the `ID(s)` along with signature schemes, split multiple IDs with ','. others are stripped")
+	strip.Var(&stripDrop, "drop", "strip the `ID(s)` only, split multiple IDs with ','. instead of -keep")
+	strip.StringVar(&stripOut, "o", "", "`output` file of stripped apk. default is <input>-stripped.apk in input's dir")
+	strip.BoolVar(&stripHelp, "h", false, "print `help` message of strip command")
 }
 
 // ./walle show xxxx.apk
@@ -84,10 +267,18 @@ func main() {
 			exit("Error: no apk files!")
 		}
 
-		if showRaw {
-			walle.PrintRaw(args)
+		opts := walle.ReadOptions{Logger: newLogger(showDebug, false)}
+		var err error
+		if showSchemes {
+			err = walle.PrintSignatureSchemes(args)
+		} else if showRaw {
+			err = walle.PrintRaw(args, opts)
 		} else {
-			walle.PrintChannel(args)
+			err = walle.PrintChannel(args, opts)
+		}
+		if err != nil {
+			// errors are printed along with files
+			os.Exit(walle.ExitCode(err))
 		}
 		break
 	case "gen":
@@ -103,8 +294,241 @@ func main() {
 		if len(args) > 1 {
 			fmt.Println("Warning: too many input files, only first one will be used!")
 		}
-		walle.GenerateChannelApk(genOut, genChannels, genExtras, args[0], genForce, genDebug)
+		opts := walle.GenerateOptions{
+			Force:           genForce,
+			Verify:          genVerify,
+			Manifest:        genManifest,
+			Checksums:       genChecksum,
+			ChecksumSidecar: genSidecar,
+			ChecksumSums:    genSums,
+			ChannelPattern:  compilePattern(genPat),
+			Logger:          newLogger(genDebug, genQuiet),
+			V4:              genV4,
+			Format:          walle.ChannelFormat(genFormat),
+
+			StripSourceStamp:    genNoStamp,
+			StripDependencyInfo: genNoDeps,
+		}
+		if genV4 {
+			opts.V4Key = loadV4Key()
+		}
+		if !genQuiet {
+			opts.Progress = walle.ProgressPrinter(os.Stdout)
+		}
+		ctx, stop := interruptibleContext()
+		defer stop()
+		var generated []walle.GeneratedApk
+		var err error
+		total := len(genChannels)
+		if len(genConfig) != 0 {
+			var config *walle.ChannelConfig
+			if config, err = walle.ReadChannelConfig(genConfig); err != nil {
+				exitErr(err)
+			}
+			total = len(config.ChannelInfoList)
+			generated, err = walle.GenerateChannelApkWithConfig(ctx, genOut, config, args[0], opts)
+		} else {
+			generated, err = walle.GenerateChannelApk(ctx, genOut, genChannels, genExtras, args[0], opts)
+		}
+		if err != nil && ctx.Err() != nil {
+			completed := make([]string, len(generated))
+			for i, g := range generated {
+				completed[i] = g.Channel
+			}
+			fmt.Fprintf(os.Stderr, "Interrupted, %d of %d channel(s) completed: %s\n", len(generated), total, strings.Join(completed, ","))
+			os.Exit(walle.ExitInterrupted)
+		}
+		if err != nil {
+			exitErr(err)
+		}
 
+		break
+	case "sign":
+		sign.Parse(os.Args[2:])
+		if signHelp {
+			printUsageOfSign()
+			break
+		}
+		args := sign.Args()
+		if len(args) == 0 {
+			exit("Error: no input file!")
+		}
+		var key crypto.Signer
+		var certs []*x509.Certificate
+		var err error
+		if len(signKs) != 0 {
+			storePass, e := walle.ReadPassword(signKsPass)
+			if e != nil {
+				exit("Error: -ks-pass " + e.Error())
+			}
+			keyPass, e := walle.ReadPassword(signKeyPass)
+			if e != nil {
+				exit("Error: -key-pass " + e.Error())
+			}
+			key, certs, err = walle.LoadKeyStore(signKs, signKsAlias, storePass, keyPass)
+		} else if len(signKey) != 0 && len(signCert) != 0 {
+			key, certs, err = walle.LoadPemKeyPair(signKey, signCert)
+		} else {
+			exit("Error: either -ks or both -key and -cert are required!")
+		}
+		if err != nil {
+			exitErr(err)
+		}
+		out := signOut
+		if len(out) == 0 {
+			ext := filepath.Ext(args[0])
+			out = strings.TrimSuffix(args[0], ext) + "-signed" + ext
+		}
+		if err = walle.Sign(args[0], out, key, certs, signV3); err != nil {
+			exitErr(err)
+		}
+		fmt.Println("Signed", out)
+		break
+	case "serve":
+		serve.Parse(os.Args[2:])
+		if serveHelp {
+			printUsageOfServe()
+			break
+		}
+		if len(serveBase) == 0 {
+			exit("Error: no base apk specified!")
+		}
+		if len(serveAllow) == 0 {
+			exit("Error: no channel allowlist specified!")
+		}
+		allowlist, err := walle.ReadChannelList(serveAllow)
+		if err != nil {
+			exitErr(err)
+		}
+		server, err := walle.NewChannelServer(serveBase, allowlist, compilePattern(servePat), walle.ChannelFormat(serveFormat))
+		if err != nil {
+			exitErr(err)
+		}
+		http.Handle("/download", server)
+		fmt.Printf("Serving %d channel(s) of %s on %s ...\n", len(allowlist), filepath.Base(serveBase), serveAddr)
+		exit(http.ListenAndServe(serveAddr, nil).Error())
+	case "watch":
+		watch.Parse(os.Args[2:])
+		if watchHelp {
+			printUsageOfWatch()
+			break
+		}
+		if len(watchDir) == 0 {
+			exit("Error: no dir to watch!")
+		}
+		if len(watchConfig) == 0 {
+			exit("Error: no channel config specified!")
+		}
+		if len(watchOut) == 0 {
+			exit("Error: no output dir specified!")
+		}
+		config, err := walle.ReadChannelConfig(watchConfig)
+		if err != nil {
+			exitErr(err)
+		}
+		opts := walle.GenerateOptions{
+			Force:          watchForce,
+			Verify:         watchVerify,
+			ChannelPattern: compilePattern(watchPat),
+			Logger:         newLogger(watchDebug, watchQuiet),
+		}
+		if !watchQuiet {
+			opts.Progress = walle.ProgressPrinter(os.Stdout)
+		}
+		ctx, stop := interruptibleContext()
+		defer stop()
+		err = walle.Watch(ctx, watchDir, watchOut, config, opts)
+		if ctx.Err() != nil {
+			fmt.Println("Interrupted, stop watching", watchDir)
+			break
+		}
+		exitErr(err)
+	case "check-manifest":
+		check.Parse(os.Args[2:])
+		if checkHelp {
+			printUsageOfCheckManifest()
+			break
+		}
+		args := check.Args()
+		if len(args) == 0 {
+			exit("Error: no manifest file!")
+		}
+		m, errs, err := walle.CheckManifest(args[0])
+		if err != nil {
+			exitErr(err)
+		}
+		failed := 0
+		for i, f := range m.Files {
+			if errs[i] != nil {
+				failed++
+				fmt.Printf("FAILED %s: %s\n", f.File, errs[i])
+			} else {
+				fmt.Printf("OK     %s\n", f.File)
+			}
+		}
+		if failed != 0 {
+			exit(fmt.Sprintf("Error: %d of %d file(s) failed on checking!", failed, len(m.Files)))
+		}
+		fmt.Printf("All %d file(s) are OK.\n", len(m.Files))
+		break
+	case "diff":
+		diff.Parse(os.Args[2:])
+		if diffHelp {
+			printUsageOfDiff()
+			break
+		}
+		args := diff.Args()
+		// as GNU diff does, 1 is for apks differ, 2 for trouble
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "Error: diff requires exactly two apk files!")
+			os.Exit(walle.ExitUsage)
+		}
+		d, err := walle.DiffApk(args[0], args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+			os.Exit(walle.ExitUsage)
+		}
+		if diffJSON {
+			data, err := json.MarshalIndent(d, "", "  ")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+				os.Exit(walle.ExitUsage)
+			}
+			fmt.Println(string(data))
+		} else {
+			fmt.Print(d.Text(diffAll))
+		}
+		if !d.Identical {
+			os.Exit(walle.ExitError)
+		}
+		break
+	case "strip":
+		strip.Parse(os.Args[2:])
+		if stripHelp {
+			printUsageOfStrip()
+			break
+		}
+		args := strip.Args()
+		if len(args) == 0 {
+			exit("Error: no input file!")
+		}
+		out := stripOut
+		if len(out) == 0 {
+			ext := filepath.Ext(args[0])
+			out = strings.TrimSuffix(args[0], ext) + "-stripped" + ext
+		}
+		stripped, err := walle.Strip(args[0], out, walle.StripOptions{Keep: stripKeep, Drop: stripDrop})
+		if err != nil {
+			exitErr(err)
+		}
+		for _, id := range stripped {
+			if name := walle.SigningBlockIdName(id); len(name) != 0 {
+				fmt.Printf("Stripped 0x%08x (%s)\n", id, name)
+			} else {
+				fmt.Printf("Stripped 0x%08x\n", id)
+			}
+		}
+		fmt.Println("Written", out)
 		break
 	case "help":
 		printHelp()
@@ -112,29 +536,154 @@ func main() {
 		printUsageOfShow()
 		fmt.Println()
 		printUsageOfGen()
+		fmt.Println()
+		printUsageOfSign()
+		fmt.Println()
+		printUsageOfServe()
+		fmt.Println()
+		printUsageOfWatch()
+		fmt.Println()
+		printUsageOfCheckManifest()
+		fmt.Println()
+		printUsageOfDiff()
+		fmt.Println()
+		printUsageOfStrip()
 		break;
 	default:
 		printHelp()
 		break
 	}
 }
+// Load the key to re-sign v4 signatures by gen -v4, nil if neither -key nor -ks is specified,
+// then gen reports that the key is required.
+func loadV4Key() crypto.Signer {
+	var key crypto.Signer
+	var err error
+	if len(genKs) != 0 {
+		storePass, e := walle.ReadPassword(genKsPass)
+		if e != nil {
+			exit("Error: -ks-pass " + e.Error())
+		}
+		keyPass, e := walle.ReadPassword(genKeyPass)
+		if e != nil {
+			exit("Error: -key-pass " + e.Error())
+		}
+		key, _, err = walle.LoadKeyStore(genKs, genKsAlias, storePass, keyPass)
+	} else if len(genKey) != 0 {
+		key, err = walle.LoadPemKey(genKey)
+	}
+	if err != nil {
+		exitErr(err)
+	}
+	return key
+}
+
+// Returns a context canceled on SIGINT or SIGTERM, so that generating stops and cleans up.
+func interruptibleContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// Returns a logger printing into stderr, debug logs are printed if verbose, and only errors
+// are printed if quiet.
+func newLogger(verbose, quiet bool) *slog.Logger {
+	level := slog.LevelInfo
+	if verbose {
+		level = slog.LevelDebug
+	} else if quiet {
+		level = slog.LevelError
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+}
+
+// Compile the pattern of valid channels, nil for the default pattern if it is empty.
+func compilePattern(pattern string) *regexp.Regexp {
+	if len(pattern) == 0 {
+		return nil
+	}
+	p, err := regexp.Compile(pattern)
+	if err != nil {
+		exit("Error: invalid channel pattern, " + err.Error())
+	}
+	return p
+}
+
 func exit(v string) {
 	fmt.Fprintln(os.Stderr, v)
-	os.Exit(1)
+	os.Exit(walle.ExitError)
+}
+
+// Exit with the exit code of err, so that e.g. an apk not signed with v2 can be told apart
+// from a broken one, see walle.ExitCode.
+func exitErr(err error) {
+	fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+	os.Exit(walle.ExitCode(err))
 }
 func printUsageOfGen() {
-	fmt.Printf("%s  gen [-o out] -c <channels> [-e extras] <file>\n", command)
+	fmt.Printf("%s  gen [-o out] [-v|-q] [-verify] [-manifest manifest.json] -c <channels> [-e extras] <file>\n", command)
+	fmt.Printf("%s  gen [-o out] [-v|-q] [-verify] [-manifest manifest.json] -config <walle.json> <file>\n", command)
 	gen.VisitAll(printFlag)
 	fmt.Println("  e.g gen -c test /foo/bar/A.apk")
 	fmt.Println("      gen -o /foo/bar/channel/ -c test /foo/bar/A.apk")
 	fmt.Println("      gen -o /foo/bar/channel/ -c test1,test2 /foo/bar/A.apk")
+	fmt.Println("      gen -c test -e url=\"https://foo.bar/?a=1,b=2\" -e @extras.json /foo/bar/A.apk")
+	fmt.Println("      gen -o /foo/bar/channel/ -config walle.json -manifest /foo/bar/channel/manifest.json /foo/bar/A.apk")
+	fmt.Println("      gen -o /foo/bar/channel/ -sidecar -sums -checksum sha256,md5 -c test1,test2 /foo/bar/A.apk")
+	fmt.Println("      gen -o /foo/bar/channel/ -v4 -key key.pem -c test1,test2 /foo/bar/A.apk")
+	fmt.Println("      gen -o /foo/bar/channel/ -format vasdolly -c test1,test2 /foo/bar/A.apk")
+	fmt.Println("      gen -o /foo/bar/channel/ -format packerng -c test1,test2 -e a=1 /foo/bar/A.apk")
+}
+
+func printUsageOfCheckManifest() {
+	fmt.Printf("%s  check-manifest <manifest.json>\n", command)
+	check.VisitAll(printFlag)
+	fmt.Println("  e.g check-manifest /foo/bar/channel/manifest.json")
+}
+
+func printUsageOfSign() {
+	fmt.Printf("%s  sign -key <key.pem> -cert <cert.pem> [-v3] [-o out] <file>\n", command)
+	fmt.Printf("%s  sign -ks <keystore> [-ks-alias alias] -ks-pass <password> [-key-pass password] [-v3] [-o out] <file>\n", command)
+	sign.VisitAll(printFlag)
+	fmt.Println("  e.g sign -key key.pem -cert cert.pem /foo/bar/A.apk")
+	fmt.Println("      sign -ks release.jks -ks-alias app -ks-pass env:KS_PASS /foo/bar/A.apk")
+	fmt.Println("      sign -key key.pem -cert cert.pem -v3 -o /foo/bar/A-signed.apk /foo/bar/A.apk")
+}
+
+func printUsageOfServe() {
+	fmt.Printf("%s  serve -base <file> -allow <allowlist> [-addr address] [-format walle|vasdolly|packerng]\n", command)
+	serve.VisitAll(printFlag)
+	fmt.Println("  e.g serve -base /foo/bar/A.apk -allow channels.txt -addr :8080")
+	fmt.Println("      then download channel apk from http://localhost:8080/download?channel=test")
+}
+
+func printUsageOfWatch() {
+	fmt.Printf("%s  watch -dir <dir> -config <walle.json> -o <out> [-f] [-verify] [-v|-q]\n", command)
+	watch.VisitAll(printFlag)
+	fmt.Println("  e.g watch -dir /foo/incoming -config walle.json -o /foo/channel")
+}
+
+func printUsageOfDiff() {
+	fmt.Printf("%s  diff [-a] [-json] <a.apk> <b.apk>\n", command)
+	diff.VisitAll(printFlag)
+	fmt.Println("  exit status is 0 if apks are identical, 1 if they differ, 2 on error")
+	fmt.Println("  e.g diff /foo/bar/A.apk /foo/bar/A-store.apk")
+	fmt.Println("      diff -json /foo/bar/A.apk /foo/bar/A-store.apk")
+}
+
+func printUsageOfStrip() {
+	fmt.Printf("%s  strip [-keep ids | -drop ids] [-o out] <file>\n", command)
+	strip.VisitAll(printFlag)
+	fmt.Println("  signature schemes v2, v3, v3.1 and verity padding are always kept")
+	fmt.Println("  e.g strip /foo/bar/A.apk")
+	fmt.Println("      strip -keep 0x71777777,0x6dff800d -o /foo/bar/A-clean.apk /foo/bar/A.apk")
+	fmt.Println("      strip -drop 0x504b4453 /foo/bar/A.apk")
 }
 
 func printUsageOfShow() {
-	fmt.Printf("%s  show [-r] <files...>\n", command)
+	fmt.Printf("%s  show [-r|-s] [-v] <files...>\n", command)
 	show.VisitAll(printFlag)
 	fmt.Println("  e.g show /foo/bar/A.apk /foo/bar/bar/B.apk")
 	fmt.Println("      show -r /foo/bar/A.apk")
+	fmt.Println("      show -s /foo/bar/A.apk")
 }
 
 func printFlag(f *flag.Flag) {
@@ -157,6 +706,12 @@ func printHelp() {
 	fmt.Println("Commands")
 	fmt.Println("  show \tget channel info from apk and show all by default")
 	fmt.Println("  gen \tgenerate apk with channel info")
+	fmt.Println("  sign \tsign apk with APK Signature Scheme v2/v3")
+	fmt.Println("  serve \tserve channel apks generated on the fly over HTTP")
+	fmt.Println("  watch \twatch a dir and generate channel apks for new apks")
+	fmt.Println("  diff \tcompare EOCD, APK Signing Block and channel of two apks")
+	fmt.Println("  strip \tstrip ID-value pairs other than signature schemes from APK Signing Block")
+	fmt.Println("  check-manifest \tre-verify generated channel apks against the manifest written by gen")
 	fmt.Println("  help \tprint help message")
 	fmt.Println()
 	fmt.Printf("%s <command> -h for more useful info\n", command)